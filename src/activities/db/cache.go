@@ -0,0 +1,68 @@
+package db
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/pgvector/pgvector-go"
+)
+
+// EmbeddingCache is the Postgres implementation of llm.EmbeddingCache.
+type EmbeddingCache struct{}
+
+func (EmbeddingCache) GetEmbeddings(ctx context.Context, model string, hashes []string) (map[string][]float32, error) {
+	conn, err := getConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close(ctx)
+
+	rows, err := conn.Query(
+		ctx,
+		"SELECT content_hash, embedding FROM embedding_cache WHERE model=$1 AND content_hash = ANY($2)",
+		model,
+		hashes,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error reading embedding cache: %w", err)
+	}
+	defer rows.Close()
+
+	embeddings := map[string][]float32{}
+	for rows.Next() {
+		var hash string
+		var embedding pgvector.Vector
+		if err := rows.Scan(&hash, &embedding); err != nil {
+			return nil, fmt.Errorf("error reading embedding cache: %w", err)
+		}
+		embeddings[hash] = embedding.Slice()
+	}
+	return embeddings, rows.Err()
+}
+
+func (EmbeddingCache) PutEmbeddings(ctx context.Context, model string, embeddings map[string][]float32) error {
+	if len(embeddings) == 0 {
+		return nil
+	}
+
+	conn, err := getConnection(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(ctx)
+
+	batch := &pgx.Batch{}
+	for hash, embedding := range embeddings {
+		batch.Queue(
+			"INSERT INTO embedding_cache (model, content_hash, embedding) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING",
+			model,
+			hash,
+			pgvector.NewVector(embedding),
+		)
+	}
+	if err := conn.SendBatch(ctx, batch).Close(); err != nil {
+		return fmt.Errorf("error saving embedding cache: %w", err)
+	}
+	return nil
+}
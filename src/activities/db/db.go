@@ -2,6 +2,7 @@ package db
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 
@@ -21,15 +22,53 @@ func getConnection(ctx context.Context) (*pgx.Conn, error) {
 	return conn, nil
 }
 
+// CheckEmbeddingDimensions fails unless the embedding column of documents
+// holds vectors of the given length, since inserting any other length would
+// fail every ingestion.
+func CheckEmbeddingDimensions(ctx context.Context, dimensions int) error {
+	conn, err := getConnection(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(ctx)
+
+	// pgvector records the dimension of a vector column as its type modifier,
+	// or -1 when the column accepts any dimension.
+	var columnDimensions int
+	err = conn.QueryRow(
+		ctx,
+		"SELECT atttypmod FROM pg_attribute WHERE attrelid = 'documents'::regclass AND attname = 'embedding'",
+	).Scan(&columnDimensions)
+	if err != nil {
+		return fmt.Errorf("error reading the dimension of documents.embedding: %w", err)
+	}
+	if columnDimensions > 0 && columnDimensions != dimensions {
+		return fmt.Errorf("documents.embedding holds vectors of %d dimensions, but embeddings have %d; change EMBEDDING_DIMENSIONS or migrate the column", columnDimensions, dimensions)
+	}
+	return nil
+}
+
 type EmbeddingRecord struct {
 	Repository string
+	Commit     string
 	Key        string
+	StartLine  int
+	EndLine    int
+	Offset     int
 	Content    string
 	Embedding  []float32
+	// Score orders the records of one retrieval: the cosine similarity in
+	// vector mode, the full-text rank in lexical mode and the reciprocal rank
+	// fusion score in hybrid mode.
+	Score float64
 }
 type InsertEmbeddingInput struct {
-	EmbeddingRecord
-	Bucket string
+	Repository string
+	Commit     string
+	// EmbeddingModel is the model that embedded the chunks.
+	EmbeddingModel string
+	Key            string
+	Chunks         []llm.EmbeddedChunk
 }
 
 func InsertEmbedding(ctx context.Context, input InsertEmbeddingInput) error {
@@ -37,85 +76,284 @@ func InsertEmbedding(ctx context.Context, input InsertEmbeddingInput) error {
 	if err != nil {
 		return err
 	}
+	defer conn.Close(ctx)
+
+	metadata := PathMetadata(input.Key)
+	batch := &pgx.Batch{}
+	for _, chunk := range input.Chunks {
+		batch.Queue(
+			`INSERT INTO documents (repository, commit_sha, embedding_model, key, start_line, end_line, start_offset, content, embedding, language, directory, extension) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+			ON CONFLICT (repository, commit_sha, embedding_model, key, start_line, start_offset) DO UPDATE
+			SET end_line = EXCLUDED.end_line, content = EXCLUDED.content, embedding = EXCLUDED.embedding,
+				language = EXCLUDED.language, directory = EXCLUDED.directory, extension = EXCLUDED.extension`,
+			input.Repository,
+			input.Commit,
+			input.EmbeddingModel,
+			input.Key,
+			chunk.StartLine,
+			chunk.EndLine,
+			chunk.Offset,
+			chunk.Content,
+			pgvector.NewVector(chunk.Embedding),
+			metadata.Language,
+			metadata.Directory,
+			metadata.Extension,
+		)
+	}
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if err := tx.SendBatch(ctx, batch).Close(); err != nil {
+		return fmt.Errorf("error inserting chunks of %s: %w", input.Key, err)
+	}
+	return tx.Commit(ctx)
+}
+
+// Keys may be listed inline or, for large repositories, in manifests stored in
+// Bucket by git.ArchiveRepository, which keeps them out of workflow history.
+// Only the documents embedded with EmbeddingModel are deleted.
+type DeleteDocumentsInput struct {
+	Repository     string
+	Commit         string
+	EmbeddingModel string
+	Keys           []string
+	Bucket         string
+	Manifests      []string
+	All            bool
+}
+
+func DeleteDocuments(ctx context.Context, input DeleteDocumentsInput) (int, error) {
+	keys, err := readManifests(input.Bucket, input.Manifests, input.Keys)
+	if err != nil {
+		return 0, err
+	}
+
+	conn, err := getConnection(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close(ctx)
+
+	var query string
+	var args []any
+	if input.All {
+		query = "DELETE FROM documents WHERE repository=$1 AND commit_sha=$2 AND embedding_model=$3"
+		args = []any{input.Repository, input.Commit, input.EmbeddingModel}
+	} else {
+		query = "DELETE FROM documents WHERE repository=$1 AND commit_sha=$2 AND embedding_model=$3 AND key = ANY($4)"
+		args = []any{input.Repository, input.Commit, input.EmbeddingModel, keys}
+	}
+
+	tag, err := conn.Exec(ctx, query, args...)
+	if err != nil {
+		return 0, fmt.Errorf("error deleting documents: %w", err)
+	}
+	return int(tag.RowsAffected()), nil
+}
+
+type CopyDocumentsInput struct {
+	Repository string
+	FromCommit string
+	ToCommit   string
+	// EmbeddingModel selects the documents copied, and replaced, by the
+	// model that embedded them.
+	EmbeddingModel string
+	ExcludeKeys    []string
+	// Bucket and ExcludeManifests name further keys to exclude, as in
+	// DeleteDocumentsInput.
+	Bucket           string
+	ExcludeManifests []string
+}
+
+// CopyDocuments carries the unchanged documents of one commit over to another,
+// replacing any rows a previous attempt already copied.
+func CopyDocuments(ctx context.Context, input CopyDocumentsInput) (int, error) {
+	excludeKeys, err := readManifests(input.Bucket, input.ExcludeManifests, input.ExcludeKeys)
+	if err != nil {
+		return 0, err
+	}
+	if excludeKeys == nil {
+		excludeKeys = []string{}
+	}
+
+	conn, err := getConnection(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close(ctx)
 
-	content, err := s3.GetObject(input.Bucket, input.Key)
+	tx, err := conn.Begin(ctx)
 	if err != nil {
-		return fmt.Errorf("error getting related document %s from bucket: %w", input.Key, err)
+		return 0, err
 	}
+	defer tx.Rollback(ctx)
 
-	_, err = conn.Exec(
+	_, err = tx.Exec(
 		ctx,
-		"INSERT INTO documents (repository, key, content, embedding) VALUES ($1, $2, $3, $4)",
+		"DELETE FROM documents WHERE repository=$1 AND commit_sha=$2 AND embedding_model=$3 AND NOT key = ANY($4)",
 		input.Repository,
-		input.Key,
-		content,
-		pgvector.NewVector(input.Embedding),
+		input.ToCommit,
+		input.EmbeddingModel,
+		excludeKeys,
 	)
-	return err
+	if err != nil {
+		return 0, fmt.Errorf("error clearing copied documents: %w", err)
+	}
+
+	tag, err := tx.Exec(
+		ctx,
+		`INSERT INTO documents (repository, commit_sha, embedding_model, key, start_line, end_line, start_offset, content, embedding, language, directory, extension)
+		SELECT repository, $3, embedding_model, key, start_line, end_line, start_offset, content, embedding, language, directory, extension FROM documents
+		WHERE repository=$1 AND commit_sha=$2 AND embedding_model=$4 AND NOT key = ANY($5)`,
+		input.Repository,
+		input.FromCommit,
+		input.ToCommit,
+		input.EmbeddingModel,
+		excludeKeys,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("error copying documents: %w", err)
+	}
+
+	return int(tag.RowsAffected()), tx.Commit(ctx)
 }
 
-type GetEmbeddingCountInput struct {
+// readManifests returns keys followed by the keys listed in each manifest.
+func readManifests(bucket string, manifests []string, keys []string) ([]string, error) {
+	for _, manifest := range manifests {
+		listed, err := s3.GetManifest(bucket, manifest)
+		if err != nil {
+			return nil, fmt.Errorf("error reading manifest %s from bucket: %w", manifest, err)
+		}
+		keys = append(keys[:len(keys):len(keys)], listed...)
+	}
+	return keys, nil
+}
+
+type IsCommitIndexedInput struct {
 	Repository string
+	Commit     string
+	// EmbeddingModel is the model the commit must have been embedded with.
+	EmbeddingModel string
 }
 
-func GetEmbeddingCount(ctx context.Context, input GetEmbeddingCountInput) (int, error) {
+func IsCommitIndexed(ctx context.Context, input IsCommitIndexedInput) (bool, error) {
 	conn, err := getConnection(ctx)
 	if err != nil {
-		return 0, err
+		return false, err
 	}
+	defer conn.Close(ctx)
 
-	var count int
-	query := "SELECT COUNT(*) FROM documents WHERE repository=$1"
-	err = conn.QueryRow(ctx, query, input.Repository).Scan(&count)
+	var indexed bool
+	query := "SELECT EXISTS (SELECT 1 FROM repositories WHERE repository=$1 AND commit_sha=$2 AND embedding_model=$3)"
+	err = conn.QueryRow(ctx, query, input.Repository, input.Commit, input.EmbeddingModel).Scan(&indexed)
 	if err != nil {
-		return 0, fmt.Errorf("error fetching document count: %w", err)
+		return false, fmt.Errorf("error checking indexed commits: %w", err)
 	}
 
-	return count, nil
+	return indexed, nil
 }
 
-type GetRelatedDocumentsInput struct {
+type SetRepositoryCommitInput struct {
 	Repository string
-	Query      string
-	Limit      int
-}
-type GetRelatedDocumentsOutput struct {
-	Records []EmbeddingRecord
+	Ref        string
+	Commit     string
+	// EmbeddingModel is the model the commit was indexed with.
+	EmbeddingModel string
+	FilesFailed    int
 }
 
-func GetRelatedDocuments(ctx context.Context, input GetRelatedDocumentsInput) (GetRelatedDocumentsOutput, error) {
-	embeddingForQuery, err := llm.FetchEmbedding(input.Query)
+// SetRepositoryCommit points a ref at a newly indexed commit, marks it ready
+// and drops the documents it used before, of its previous commit or of the
+// same commit embedded with another model, unless another ref still uses them.
+func SetRepositoryCommit(ctx context.Context, input SetRepositoryCommitInput) error {
+	conn, err := getConnection(ctx)
 	if err != nil {
-		return GetRelatedDocumentsOutput{}, fmt.Errorf("error getting embeddings data for query %s: %w", input.Query, err)
+		return err
 	}
+	defer conn.Close(ctx)
 
-	conn, err := getConnection(ctx)
+	tx, err := conn.Begin(ctx)
 	if err != nil {
-		return GetRelatedDocumentsOutput{}, err
+		return err
 	}
+	defer tx.Rollback(ctx)
 
-	query := "SELECT key, content FROM documents WHERE repository=$1 ORDER BY embedding <=> $2 LIMIT $3"
-	rows, err := conn.Query(ctx, query, input.Repository, pgvector.NewVector(embeddingForQuery), input.Limit)
+	var previousCommit string
+	err = tx.QueryRow(
+		ctx,
+		"SELECT COALESCE(commit_sha, '') FROM repositories WHERE repository=$1 AND ref=$2 FOR UPDATE",
+		input.Repository,
+		input.Ref,
+	).Scan(&previousCommit)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return fmt.Errorf("error fetching repository commit: %w", err)
+	}
+
+	_, err = tx.Exec(
+		ctx,
+		`INSERT INTO repositories (repository, ref, commit_sha, status, phase, embedding_model, files_indexed, chunks_indexed, files_failed, finished_at)
+		SELECT $1, $2, $3, 'ready', 'done', $4, COUNT(DISTINCT key), COUNT(*), $5, now()
+		FROM documents WHERE repository=$1 AND commit_sha=$3 AND embedding_model=$4
+		ON CONFLICT (repository, ref) DO UPDATE SET
+			commit_sha = EXCLUDED.commit_sha,
+			status = EXCLUDED.status,
+			phase = EXCLUDED.phase,
+			pending_commit = NULL,
+			embedding_model = EXCLUDED.embedding_model,
+			files_indexed = EXCLUDED.files_indexed,
+			chunks_indexed = EXCLUDED.chunks_indexed,
+			files_failed = EXCLUDED.files_failed,
+			last_error = NULL,
+			finished_at = EXCLUDED.finished_at,
+			updated_at = now()`,
+		input.Repository,
+		input.Ref,
+		input.Commit,
+		input.EmbeddingModel,
+		input.FilesFailed,
+	)
 	if err != nil {
-		return GetRelatedDocumentsOutput{}, fmt.Errorf("error fetching related documents: %w", err)
+		return fmt.Errorf("error saving repository commit: %w", err)
 	}
-	defer rows.Close()
 
-	var relatedRecords []EmbeddingRecord
-	for rows.Next() {
-		var doc EmbeddingRecord
-		err = rows.Scan(&doc.Key, &doc.Content)
+	if previousCommit != "" {
+		_, err = tx.Exec(ctx, deleteUnreferencedDocuments, input.Repository, previousCommit)
 		if err != nil {
-			return GetRelatedDocumentsOutput{}, err
+			return fmt.Errorf("error deleting documents of commit %s: %w", previousCommit, err)
 		}
-		relatedRecords = append(relatedRecords, doc)
 	}
 
-	if rows.Err() != nil {
-		return GetRelatedDocumentsOutput{}, fmt.Errorf("error fetching related documents: %w", err)
+	return tx.Commit(ctx)
+}
+
+// deleteUnreferencedDocuments drops the documents of a commit that no ref
+// uses: all of them when no ref points at the commit, otherwise those embedded
+// with another model than the refs that do.
+const deleteUnreferencedDocuments = `DELETE FROM documents d WHERE d.repository=$1 AND d.commit_sha=$2
+AND NOT EXISTS (SELECT 1 FROM repositories r WHERE r.repository=$1 AND r.commit_sha=$2 AND r.embedding_model=d.embedding_model)`
+
+type DeleteUnreferencedDocumentsInput struct {
+	Repository string
+	Commit     string
+}
+
+// DeleteUnreferencedDocuments drops the documents of a commit no ref points
+// at, such as the rows left by an ingestion that failed part way through.
+func DeleteUnreferencedDocuments(ctx context.Context, input DeleteUnreferencedDocumentsInput) (int, error) {
+	conn, err := getConnection(ctx)
+	if err != nil {
+		return 0, err
 	}
+	defer conn.Close(ctx)
 
-	return GetRelatedDocumentsOutput{
-		Records: relatedRecords,
-	}, nil
+	tag, err := conn.Exec(ctx, deleteUnreferencedDocuments, input.Repository, input.Commit)
+	if err != nil {
+		return 0, fmt.Errorf("error deleting documents of commit %s: %w", input.Commit, err)
+	}
+	return int(tag.RowsAffected()), nil
 }
@@ -0,0 +1,152 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"bitovi.com/code-analyzer/src/activities/llm"
+	"bitovi.com/code-analyzer/src/utils"
+	"go.temporal.io/sdk/activity"
+)
+
+// IndexFilesInput lists the archived files of a batch by their keys in Bucket.
+type IndexFilesInput struct {
+	Repository string
+	Commit     string
+	Bucket     string
+	Keys       []string
+}
+type IndexFilesOutput struct {
+	FilesEmbedded int
+	FilesSkipped  int
+	RowsInserted  int
+	// ChunksCached counts the chunks whose embedding came from the cache
+	// rather than the embedder.
+	ChunksCached int
+	// FailedFiles lists the files the embedder rejected. They are left out of
+	// the index rather than failing the whole ingestion.
+	FilesFailed int
+	FailedFiles []FailedFile
+}
+
+type FailedFile struct {
+	Key   string
+	Error string
+}
+
+type indexFilesHeartbeat struct {
+	Next   int
+	Output IndexFilesOutput
+}
+
+// IndexFiles embeds and stores a batch of archived files in a single activity,
+// so that ingestion costs a handful of history events per batch rather than
+// several per file. The chunks of all files are embedded together, then each
+// file is stored and heartbeated, and a retried attempt resumes after the last
+// file stored.
+func IndexFiles(ctx context.Context, input IndexFilesInput) (IndexFilesOutput, error) {
+	var progress indexFilesHeartbeat
+	if activity.HasHeartbeatDetails(ctx) {
+		var previous indexFilesHeartbeat
+		if err := activity.GetHeartbeatDetails(ctx, &previous); err == nil {
+			progress = previous
+		}
+	}
+
+	if progress.Next >= len(input.Keys) {
+		return progress.Output, nil
+	}
+	model, err := llm.GetEmbeddingModel(ctx)
+	if err != nil {
+		return IndexFilesOutput{}, err
+	}
+	stop := keepAlive(ctx, progress)
+	embeddings, err := llm.GetEmbeddingDataBatch(ctx, llm.GetEmbeddingDataBatchInput{
+		Bucket: input.Bucket,
+		Keys:   input.Keys[progress.Next:],
+	})
+	failures := map[string]error{}
+	if utils.ErrorType(err) == utils.ErrInvalidInput {
+		// One of the files was rejected, embed them one at a time to find out
+		// which.
+		embeddings, err = embedEach(ctx, input.Bucket, input.Keys[progress.Next:], failures)
+	}
+	stop()
+	if err != nil {
+		return IndexFilesOutput{}, err
+	}
+	progress.Output.ChunksCached += embeddings.CachedChunks
+
+	for _, embedding := range embeddings.Files {
+		if failure, ok := failures[embedding.Key]; ok {
+			progress.Output.FilesFailed++
+			progress.Output.FailedFiles = append(progress.Output.FailedFiles, FailedFile{
+				Key:   embedding.Key,
+				Error: failure.Error(),
+			})
+		} else if len(embedding.Chunks) == 0 {
+			progress.Output.FilesSkipped++
+		} else {
+			err = InsertEmbedding(ctx, InsertEmbeddingInput{
+				Repository:     input.Repository,
+				Commit:         input.Commit,
+				EmbeddingModel: model,
+				Key:            embedding.Key,
+				Chunks:         embedding.Chunks,
+			})
+			if err != nil {
+				return IndexFilesOutput{}, err
+			}
+			progress.Output.FilesEmbedded++
+			progress.Output.RowsInserted += len(embedding.Chunks)
+		}
+
+		progress.Next++
+		activity.RecordHeartbeat(ctx, progress)
+	}
+
+	return progress.Output, nil
+}
+
+// keepAlive heartbeats progress every few seconds until stopped, since files
+// are not cut short and embedding a batch with large ones can take longer
+// than the heartbeat timeout.
+func keepAlive(ctx context.Context, progress indexFilesHeartbeat) func() {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(5 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				activity.RecordHeartbeat(ctx, progress)
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// embedEach embeds files one at a time, recording in failures the files whose
+// embedding was rejected as invalid. Any other error stops it.
+func embedEach(ctx context.Context, bucket string, keys []string, failures map[string]error) (llm.GetEmbeddingDataBatchOutput, error) {
+	var output llm.GetEmbeddingDataBatchOutput
+	for _, key := range keys {
+		file, err := llm.GetEmbeddingDataBatch(ctx, llm.GetEmbeddingDataBatchInput{
+			Bucket: bucket,
+			Keys:   []string{key},
+		})
+		if utils.ErrorType(err) == utils.ErrInvalidInput {
+			failures[key] = err
+			output.Files = append(output.Files, llm.GetEmbeddingDataOutput{Key: key})
+			continue
+		}
+		if err != nil {
+			return llm.GetEmbeddingDataBatchOutput{}, err
+		}
+		output.Files = append(output.Files, file.Files...)
+		output.CachedChunks += file.CachedChunks
+	}
+	return output, nil
+}
@@ -0,0 +1,202 @@
+package db
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// languages maps file extensions, and the names of files without one, to the
+// language stored with their documents. Migration 0006 fills in the documents
+// indexed before it from the same list.
+var languages = map[string]string{
+	"go":         "go",
+	"py":         "python",
+	"js":         "javascript",
+	"jsx":        "javascript",
+	"mjs":        "javascript",
+	"cjs":        "javascript",
+	"ts":         "typescript",
+	"tsx":        "typescript",
+	"java":       "java",
+	"kt":         "kotlin",
+	"kts":        "kotlin",
+	"scala":      "scala",
+	"rb":         "ruby",
+	"rs":         "rust",
+	"c":          "c",
+	"h":          "c",
+	"cc":         "cpp",
+	"cpp":        "cpp",
+	"cxx":        "cpp",
+	"hpp":        "cpp",
+	"cs":         "csharp",
+	"php":        "php",
+	"swift":      "swift",
+	"sh":         "shell",
+	"bash":       "shell",
+	"sql":        "sql",
+	"html":       "html",
+	"css":        "css",
+	"scss":       "scss",
+	"vue":        "vue",
+	"md":         "markdown",
+	"yaml":       "yaml",
+	"yml":        "yaml",
+	"json":       "json",
+	"toml":       "toml",
+	"proto":      "protobuf",
+	"tf":         "terraform",
+	"Dockerfile": "dockerfile",
+	"Makefile":   "makefile",
+}
+
+// DocumentMetadata is what retrieval can filter documents on besides their
+// path. Directory is empty for files at the root of the repository, Extension
+// is lower-cased and has no leading dot, and Language is empty when unknown.
+type DocumentMetadata struct {
+	Language  string
+	Directory string
+	Extension string
+}
+
+func PathMetadata(key string) DocumentMetadata {
+	directory, name := path.Split(key)
+	extension := strings.ToLower(strings.TrimPrefix(path.Ext(name), "."))
+	language := languages[extension]
+	if extension == "" {
+		language = languages[name]
+	}
+	return DocumentMetadata{
+		Language:  language,
+		Directory: strings.TrimSuffix(directory, "/"),
+		Extension: extension,
+	}
+}
+
+// DocumentFilter restricts retrieval to part of a repository. Documents must
+// match at least one of each list that is not empty, and none of Exclude.
+//
+// Include and Exclude are globs over file paths, in which * and ? match
+// within a path segment and ** across segments. A glob without a slash, such
+// as *.go, matches file names in any directory, one starting with a slash
+// only matches from the root, and one ending with a slash matches everything
+// below that directory. Languages are the names of
+// PathMetadata, such as go or typescript. Directories match the files below
+// them, in subdirectories too.
+type DocumentFilter struct {
+	Include     []string
+	Exclude     []string
+	Languages   []string
+	Directories []string
+}
+
+// Equal reports whether two filters have the same entries. A missing list is
+// the same as an empty one.
+func (f DocumentFilter) Equal(other DocumentFilter) bool {
+	return slices.Equal(f.Include, other.Include) &&
+		slices.Equal(f.Exclude, other.Exclude) &&
+		slices.Equal(f.Languages, other.Languages) &&
+		slices.Equal(f.Directories, other.Directories)
+}
+
+func (f DocumentFilter) empty() bool {
+	conditions, _ := f.where(1)
+	return conditions == ""
+}
+
+// where returns the conditions of the filter for a query over documents, to
+// be appended to its WHERE clause, and their arguments, whose placeholders
+// are numbered from $next.
+func (f DocumentFilter) where(next int) (string, []any) {
+	var conditions []string
+	var args []any
+	add := func(condition string, arg any) {
+		conditions = append(conditions, fmt.Sprintf(condition, next))
+		args = append(args, arg)
+		next++
+	}
+
+	if patterns := globPatterns(f.Include); len(patterns) > 0 {
+		add("key ~ ANY($%d)", patterns)
+	}
+	if patterns := globPatterns(f.Exclude); len(patterns) > 0 {
+		add("NOT key ~ ANY($%d)", patterns)
+	}
+	if languages := nonEmpty(f.Languages, strings.ToLower); len(languages) > 0 {
+		add("language = ANY($%d)", languages)
+	}
+	if directories := nonEmpty(f.Directories, directoryPattern); len(directories) > 0 {
+		add("directory ~ ANY($%d)", directories)
+	}
+
+	if len(conditions) == 0 {
+		return "", nil
+	}
+	return " AND " + strings.Join(conditions, " AND "), args
+}
+
+func globPatterns(globs []string) []string {
+	return nonEmpty(globs, globPattern)
+}
+
+// globPattern converts a glob to an anchored regular expression, which
+// Postgres and Go interpret alike. As in .gitignore, a glob starting with a
+// slash is relative to the root of the repository, even without another
+// slash.
+func globPattern(glob string) string {
+	rooted := strings.HasPrefix(glob, "/")
+	glob = strings.TrimPrefix(glob, "/")
+	if strings.HasSuffix(glob, "/") {
+		glob += "**"
+	}
+
+	var pattern strings.Builder
+	pattern.WriteString("^")
+	if !rooted && !strings.Contains(glob, "/") {
+		pattern.WriteString("(?:.*/)?")
+	}
+	for i := 0; i < len(glob); i++ {
+		switch {
+		case strings.HasPrefix(glob[i:], "**/"):
+			pattern.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			pattern.WriteString(".*")
+			i++
+		case glob[i] == '*':
+			pattern.WriteString("[^/]*")
+		case glob[i] == '?':
+			pattern.WriteString("[^/]")
+		default:
+			pattern.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+	}
+	pattern.WriteString("$")
+	return pattern.String()
+}
+
+func directoryPattern(directory string) string {
+	directory = strings.Trim(directory, "/")
+	if directory == "" {
+		return ""
+	}
+	return "^" + regexp.QuoteMeta(directory) + "(?:/|$)"
+}
+
+// nonEmpty applies convert to the values that are not blank and returns the
+// results that are not empty.
+func nonEmpty(values []string, convert func(string) string) []string {
+	var converted []string
+	for _, value := range values {
+		if value = strings.TrimSpace(value); value == "" {
+			continue
+		}
+		if value = convert(value); value != "" {
+			converted = append(converted, value)
+		}
+	}
+	return converted
+}
@@ -0,0 +1,94 @@
+package db
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestGlobPattern(t *testing.T) {
+	tests := []struct {
+		glob     string
+		matches  []string
+		excludes []string
+	}{
+		{
+			glob:     "*.go",
+			matches:  []string{"main.go", "src/db/db.go"},
+			excludes: []string{"main.go.orig", "src/db/db.gox", "README.md"},
+		},
+		{
+			glob:     "src/*.go",
+			matches:  []string{"src/main.go"},
+			excludes: []string{"src/db/db.go", "main.go", "other/src/main.go"},
+		},
+		{
+			glob:     "src/**/*.go",
+			matches:  []string{"src/main.go", "src/db/db.go", "src/a/b/c.go"},
+			excludes: []string{"main.go", "srcs/main.go"},
+		},
+		{
+			glob:     "docs/",
+			matches:  []string{"docs/index.md", "docs/api/v1.md"},
+			excludes: []string{"docs", "src/docs/index.md"},
+		},
+		{
+			glob:     "Makefile",
+			matches:  []string{"Makefile", "src/Makefile"},
+			excludes: []string{"Makefile.am"},
+		},
+		{
+			glob:     "/Makefile",
+			matches:  []string{"Makefile"},
+			excludes: []string{"src/Makefile", "Makefile.am"},
+		},
+		{
+			glob:     "/src/*.go",
+			matches:  []string{"src/main.go"},
+			excludes: []string{"other/src/main.go"},
+		},
+		{
+			glob:     "file?.txt",
+			matches:  []string{"file1.txt", "a/fileA.txt"},
+			excludes: []string{"file10.txt", "file/.txt"},
+		},
+		{
+			glob:     "a+b(c).txt",
+			matches:  []string{"a+b(c).txt"},
+			excludes: []string{"aab(c).txt", "ab(c).txt"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.glob, func(t *testing.T) {
+			pattern := regexp.MustCompile(globPattern(test.glob))
+			for _, path := range test.matches {
+				if !pattern.MatchString(path) {
+					t.Errorf("%s does not match %s", pattern, path)
+				}
+			}
+			for _, path := range test.excludes {
+				if pattern.MatchString(path) {
+					t.Errorf("%s matches %s", pattern, path)
+				}
+			}
+		})
+	}
+}
+
+func TestPathMetadata(t *testing.T) {
+	tests := []struct {
+		key      string
+		metadata DocumentMetadata
+	}{
+		{"main.go", DocumentMetadata{Language: "go", Extension: "go"}},
+		{"src/App.TSX", DocumentMetadata{Language: "typescript", Directory: "src", Extension: "tsx"}},
+		{"build/Dockerfile", DocumentMetadata{Language: "dockerfile", Directory: "build"}},
+		{"a/b/notes.unknown", DocumentMetadata{Directory: "a/b", Extension: "unknown"}},
+	}
+
+	for _, test := range tests {
+		if metadata := PathMetadata(test.key); metadata != test.metadata {
+			t.Errorf("PathMetadata(%q) = %+v, want %+v", test.key, metadata, test.metadata)
+		}
+	}
+}
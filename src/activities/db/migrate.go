@@ -0,0 +1,167 @@
+package db
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationLock is the key of the advisory lock that keeps several workers
+// starting at once from applying the same migrations concurrently.
+const migrationLock = 7261530214
+
+type Migration struct {
+	Version int
+	Name    string
+	SQL     string
+	Applied bool
+}
+
+func loadMigrations() ([]Migration, error) {
+	entries, err := migrationFiles.ReadDir("migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	var migrations []Migration
+	for _, entry := range entries {
+		name := strings.TrimSuffix(entry.Name(), ".sql")
+		prefix, _, _ := strings.Cut(name, "_")
+		version, err := strconv.Atoi(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("migration %s does not start with a version number", entry.Name())
+		}
+
+		sql, err := migrationFiles.ReadFile(path.Join("migrations", entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, Migration{
+			Version: version,
+			Name:    name,
+			SQL:     string(sql),
+		})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// GetMigrations lists every known migration and whether it has been applied.
+func GetMigrations(ctx context.Context) ([]Migration, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := getConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close(ctx)
+
+	var exists bool
+	err = conn.QueryRow(ctx, "SELECT to_regclass('schema_migrations') IS NOT NULL").Scan(&exists)
+	if err != nil {
+		return nil, fmt.Errorf("error checking for schema_migrations: %w", err)
+	}
+	if !exists {
+		return migrations, nil
+	}
+
+	rows, err := conn.Query(ctx, "SELECT version FROM schema_migrations")
+	if err != nil {
+		return nil, fmt.Errorf("error fetching applied migrations: %w", err)
+	}
+	defer rows.Close()
+
+	applied := map[int]bool{}
+	for rows.Next() {
+		var version int
+		if err := rows.Scan(&version); err != nil {
+			return nil, err
+		}
+		applied[version] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error fetching applied migrations: %w", err)
+	}
+
+	for i := range migrations {
+		migrations[i].Applied = applied[migrations[i].Version]
+	}
+	return migrations, nil
+}
+
+// Migrate applies every pending migration in version order, each in its own
+// transaction, and returns the names of the migrations it applied.
+func Migrate(ctx context.Context) ([]string, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := getConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close(ctx)
+
+	if _, err := conn.Exec(ctx, "SELECT pg_advisory_lock($1)", migrationLock); err != nil {
+		return nil, fmt.Errorf("error acquiring migration lock: %w", err)
+	}
+	defer conn.Exec(ctx, "SELECT pg_advisory_unlock($1)", migrationLock)
+
+	_, err = conn.Exec(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`)
+	if err != nil {
+		return nil, fmt.Errorf("error creating schema_migrations: %w", err)
+	}
+
+	var applied []string
+	for _, migration := range migrations {
+		tx, err := conn.Begin(ctx)
+		if err != nil {
+			return applied, err
+		}
+
+		var done bool
+		err = tx.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE version=$1)", migration.Version).Scan(&done)
+		if err != nil {
+			tx.Rollback(ctx)
+			return applied, fmt.Errorf("error checking migration %s: %w", migration.Name, err)
+		}
+		if done {
+			tx.Rollback(ctx)
+			continue
+		}
+
+		if _, err := tx.Exec(ctx, migration.SQL); err != nil {
+			tx.Rollback(ctx)
+			return applied, fmt.Errorf("error applying migration %s: %w", migration.Name, err)
+		}
+		_, err = tx.Exec(ctx, "INSERT INTO schema_migrations (version, name) VALUES ($1, $2)", migration.Version, migration.Name)
+		if err != nil {
+			tx.Rollback(ctx)
+			return applied, fmt.Errorf("error recording migration %s: %w", migration.Name, err)
+		}
+		if err := tx.Commit(ctx); err != nil {
+			return applied, fmt.Errorf("error committing migration %s: %w", migration.Name, err)
+		}
+		applied = append(applied, migration.Name)
+	}
+
+	return applied, nil
+}
@@ -0,0 +1,38 @@
+-- db/1-create-db.sql creates the original documents table, which stored
+-- whole files without their commit or line range. Databases without it get
+-- the same table, and both are brought up to the chunked schema.
+CREATE EXTENSION IF NOT EXISTS vector;
+
+CREATE TABLE IF NOT EXISTS documents (
+	id SERIAL PRIMARY KEY,
+	repository TEXT,
+	key TEXT,
+	content TEXT,
+	embedding vector(1536)
+);
+
+ALTER TABLE documents
+	ADD COLUMN IF NOT EXISTS commit_sha TEXT,
+	ADD COLUMN IF NOT EXISTS start_line INTEGER,
+	ADD COLUMN IF NOT EXISTS end_line INTEGER,
+	ADD COLUMN IF NOT EXISTS content_tsv tsvector GENERATED ALWAYS AS (
+		to_tsvector('simple', regexp_replace(coalesce(key, '') || ' ' || coalesce(content, ''), '[^[:alnum:]_]+', ' ', 'g'))
+	) STORED;
+
+-- Rows stored before chunking hold a whole file. Their commit is unknown, so
+-- they are left without one and retrieval, which always asks for a commit,
+-- never returns them.
+UPDATE documents SET
+	start_line = 1,
+	end_line = coalesce(array_length(string_to_array(rtrim(content, E'\n'), E'\n'), 1), 1)
+WHERE start_line IS NULL;
+
+CREATE INDEX IF NOT EXISTS documents_content_tsv_idx ON documents USING GIN (content_tsv);
+
+CREATE TABLE IF NOT EXISTS repositories (
+	repository TEXT NOT NULL,
+	ref TEXT NOT NULL,
+	commit_sha TEXT NOT NULL,
+	updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+	PRIMARY KEY (repository, ref)
+);
@@ -0,0 +1,11 @@
+-- Documents are chunks of a file at a commit, so a file is unique per
+-- repository and commit and a chunk is identified by its first line.
+DELETE FROM documents a USING documents b
+WHERE a.id > b.id
+	AND a.repository = b.repository
+	AND a.commit_sha = b.commit_sha
+	AND a.key = b.key
+	AND a.start_line = b.start_line;
+
+ALTER TABLE documents
+	ADD CONSTRAINT documents_repository_key_unique UNIQUE (repository, commit_sha, key, start_line);
@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS embedding_cache (
+	model TEXT NOT NULL,
+	content_hash TEXT NOT NULL,
+	embedding vector NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+	PRIMARY KEY (model, content_hash)
+);
@@ -0,0 +1,29 @@
+-- A ref now has a row as soon as its ingestion is requested. commit_sha stays
+-- the last commit that finished ingesting, and is null until one has.
+ALTER TABLE repositories
+	ALTER COLUMN commit_sha DROP NOT NULL,
+	ADD COLUMN status TEXT NOT NULL DEFAULT 'ready',
+	ADD COLUMN phase TEXT NOT NULL DEFAULT '',
+	ADD COLUMN pending_commit TEXT,
+	ADD COLUMN embedding_model TEXT,
+	ADD COLUMN files_indexed INTEGER NOT NULL DEFAULT 0,
+	ADD COLUMN chunks_indexed INTEGER NOT NULL DEFAULT 0,
+	ADD COLUMN files_failed INTEGER NOT NULL DEFAULT 0,
+	ADD COLUMN last_error TEXT,
+	ADD COLUMN created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+	ADD COLUMN started_at TIMESTAMPTZ,
+	ADD COLUMN finished_at TIMESTAMPTZ,
+	ADD CONSTRAINT repositories_status_check CHECK (status IN ('pending', 'ingesting', 'ready', 'failed'));
+
+ALTER TABLE repositories ALTER COLUMN status SET DEFAULT 'pending';
+
+UPDATE repositories r SET
+	files_indexed = counts.files,
+	chunks_indexed = counts.chunks,
+	finished_at = r.updated_at
+FROM (
+	SELECT repository, commit_sha, COUNT(DISTINCT key) AS files, COUNT(*) AS chunks
+	FROM documents
+	GROUP BY repository, commit_sha
+) counts
+WHERE counts.repository = r.repository AND counts.commit_sha = r.commit_sha;
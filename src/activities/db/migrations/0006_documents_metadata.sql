@@ -0,0 +1,46 @@
+-- Retrieval can be restricted by language, directory and file extension,
+-- which are derived from the path of each document when it is inserted. Rows
+-- indexed earlier are filled in here, with the languages db.PathMetadata knew
+-- when this migration was written.
+ALTER TABLE documents
+	ADD COLUMN language TEXT NOT NULL DEFAULT '',
+	ADD COLUMN directory TEXT NOT NULL DEFAULT '',
+	ADD COLUMN extension TEXT NOT NULL DEFAULT '';
+
+UPDATE documents SET
+	directory = regexp_replace(key, '/?[^/]*$', ''),
+	extension = coalesce(lower(substring(key from '\.([^./]+)$')), '');
+
+UPDATE documents SET language = CASE
+	WHEN extension = 'go' THEN 'go'
+	WHEN extension = 'py' THEN 'python'
+	WHEN extension IN ('js', 'jsx', 'mjs', 'cjs') THEN 'javascript'
+	WHEN extension IN ('ts', 'tsx') THEN 'typescript'
+	WHEN extension = 'java' THEN 'java'
+	WHEN extension IN ('kt', 'kts') THEN 'kotlin'
+	WHEN extension = 'scala' THEN 'scala'
+	WHEN extension = 'rb' THEN 'ruby'
+	WHEN extension = 'rs' THEN 'rust'
+	WHEN extension IN ('c', 'h') THEN 'c'
+	WHEN extension IN ('cc', 'cpp', 'cxx', 'hpp') THEN 'cpp'
+	WHEN extension = 'cs' THEN 'csharp'
+	WHEN extension = 'php' THEN 'php'
+	WHEN extension = 'swift' THEN 'swift'
+	WHEN extension IN ('sh', 'bash') THEN 'shell'
+	WHEN extension = 'sql' THEN 'sql'
+	WHEN extension = 'html' THEN 'html'
+	WHEN extension = 'css' THEN 'css'
+	WHEN extension = 'scss' THEN 'scss'
+	WHEN extension = 'vue' THEN 'vue'
+	WHEN extension = 'md' THEN 'markdown'
+	WHEN extension IN ('yaml', 'yml') THEN 'yaml'
+	WHEN extension = 'json' THEN 'json'
+	WHEN extension = 'toml' THEN 'toml'
+	WHEN extension = 'proto' THEN 'protobuf'
+	WHEN extension = 'tf' THEN 'terraform'
+	WHEN extension = '' AND key ~ '(^|/)Dockerfile$' THEN 'dockerfile'
+	WHEN extension = '' AND key ~ '(^|/)Makefile$' THEN 'makefile'
+	ELSE ''
+END;
+
+CREATE INDEX IF NOT EXISTS documents_language_idx ON documents (repository, commit_sha, language);
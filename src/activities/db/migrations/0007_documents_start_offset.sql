@@ -0,0 +1,9 @@
+-- A line too long for one chunk is cut into several chunks that all start on
+-- that line, so a chunk is identified by its byte offset within its first
+-- line as well. Rows indexed earlier keep offset 0.
+ALTER TABLE documents
+	ADD COLUMN start_offset INTEGER NOT NULL DEFAULT 0;
+
+ALTER TABLE documents
+	DROP CONSTRAINT documents_repository_key_unique,
+	ADD CONSTRAINT documents_repository_key_unique UNIQUE (repository, commit_sha, key, start_line, start_offset);
@@ -0,0 +1,22 @@
+-- Refs at the same commit can be indexed with different embedding models, so
+-- a document belongs to the model that embedded it as well as to its commit.
+-- Rows indexed earlier take the model of a ref at their commit, or none, which
+-- no ref matches, when no ref is at it any more.
+ALTER TABLE repositories
+	ALTER COLUMN embedding_model SET DEFAULT '';
+
+UPDATE repositories SET embedding_model = '' WHERE embedding_model IS NULL;
+
+ALTER TABLE repositories
+	ALTER COLUMN embedding_model SET NOT NULL;
+
+ALTER TABLE documents
+	ADD COLUMN embedding_model TEXT NOT NULL DEFAULT '';
+
+UPDATE documents d SET embedding_model = r.embedding_model
+FROM repositories r
+WHERE r.repository = d.repository AND r.commit_sha = d.commit_sha;
+
+ALTER TABLE documents
+	DROP CONSTRAINT documents_repository_key_unique,
+	ADD CONSTRAINT documents_repository_key_unique UNIQUE (repository, commit_sha, embedding_model, key, start_line, start_offset);
@@ -0,0 +1,226 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Statuses of the last ingestion of a ref. A ref can be queried at Commit as
+// soon as one ingestion has finished, whatever the status of the next one.
+const (
+	StatusPending   = "pending"
+	StatusIngesting = "ingesting"
+	StatusReady     = "ready"
+	StatusFailed    = "failed"
+)
+
+type Repository struct {
+	Repository string
+	Ref        string
+	// Commit is the last commit indexed for the ref, empty until the first
+	// ingestion finishes. PendingCommit is the commit being ingested.
+	Commit         string
+	PendingCommit  string
+	Status         string
+	Phase          string
+	EmbeddingModel string
+	FilesIndexed   int
+	ChunksIndexed  int
+	FilesFailed    int
+	LastError      string
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+	StartedAt      *time.Time
+	FinishedAt     *time.Time
+}
+
+const repositoryColumns = `repository, ref, COALESCE(commit_sha, ''), COALESCE(pending_commit, ''), status, phase,
+COALESCE(embedding_model, ''), files_indexed, chunks_indexed, files_failed, COALESCE(last_error, ''),
+created_at, updated_at, started_at, finished_at`
+
+func scanRepository(row pgx.Row) (Repository, error) {
+	var r Repository
+	err := row.Scan(
+		&r.Repository,
+		&r.Ref,
+		&r.Commit,
+		&r.PendingCommit,
+		&r.Status,
+		&r.Phase,
+		&r.EmbeddingModel,
+		&r.FilesIndexed,
+		&r.ChunksIndexed,
+		&r.FilesFailed,
+		&r.LastError,
+		&r.CreatedAt,
+		&r.UpdatedAt,
+		&r.StartedAt,
+		&r.FinishedAt,
+	)
+	return r, err
+}
+
+type GetRepositoryInput struct {
+	Repository string
+	Ref        string
+}
+
+// GetRepository returns the ref's row, or a Repository with an empty Status
+// if its ingestion was never requested.
+func GetRepository(ctx context.Context, input GetRepositoryInput) (Repository, error) {
+	conn, err := getConnection(ctx)
+	if err != nil {
+		return Repository{}, err
+	}
+	defer conn.Close(ctx)
+
+	repository, err := scanRepository(conn.QueryRow(
+		ctx,
+		"SELECT "+repositoryColumns+" FROM repositories WHERE repository=$1 AND ref=$2",
+		input.Repository,
+		input.Ref,
+	))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return Repository{Repository: input.Repository, Ref: input.Ref}, nil
+	}
+	if err != nil {
+		return Repository{}, fmt.Errorf("error fetching repository: %w", err)
+	}
+	return repository, nil
+}
+
+type ListRepositoriesInput struct {
+	// Repository optionally restricts the list to the refs of one repository.
+	Repository string
+}
+
+func ListRepositories(ctx context.Context, input ListRepositoriesInput) ([]Repository, error) {
+	conn, err := getConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close(ctx)
+
+	rows, err := conn.Query(
+		ctx,
+		"SELECT "+repositoryColumns+" FROM repositories WHERE $1 = '' OR repository=$1 ORDER BY repository, ref",
+		input.Repository,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error listing repositories: %w", err)
+	}
+	defer rows.Close()
+
+	var repositories []Repository
+	for rows.Next() {
+		repository, err := scanRepository(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error listing repositories: %w", err)
+		}
+		repositories = append(repositories, repository)
+	}
+	return repositories, rows.Err()
+}
+
+type UpdateRepositoryStatusInput struct {
+	Repository    string
+	Ref           string
+	Status        string
+	Phase         string
+	PendingCommit string
+	Error         string
+}
+
+// UpdateRepositoryStatus records the progress of an ingestion. The commit a
+// ref is queried at only changes with SetRepositoryCommit.
+func UpdateRepositoryStatus(ctx context.Context, input UpdateRepositoryStatusInput) error {
+	conn, err := getConnection(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(ctx)
+
+	_, err = conn.Exec(
+		ctx,
+		`INSERT INTO repositories (repository, ref, status, phase, pending_commit, last_error, started_at)
+		VALUES ($1, $2, $3, $4, NULLIF($5, ''), NULLIF($6, ''), CASE WHEN $3 = 'ingesting' THEN now() END)
+		ON CONFLICT (repository, ref) DO UPDATE SET
+			status = EXCLUDED.status,
+			phase = EXCLUDED.phase,
+			pending_commit = COALESCE(EXCLUDED.pending_commit, repositories.pending_commit),
+			last_error = EXCLUDED.last_error,
+			started_at = CASE
+				WHEN EXCLUDED.status = 'ingesting' AND repositories.status <> 'ingesting' THEN now()
+				ELSE repositories.started_at
+			END,
+			finished_at = CASE
+				WHEN EXCLUDED.status IN ('ready', 'failed') THEN now()
+				ELSE repositories.finished_at
+			END,
+			updated_at = now()`,
+		input.Repository,
+		input.Ref,
+		input.Status,
+		input.Phase,
+		input.PendingCommit,
+		input.Error,
+	)
+	if err != nil {
+		return fmt.Errorf("error updating repository status: %w", err)
+	}
+	return nil
+}
+
+type DeleteRepositoryInput struct {
+	Repository string
+	Ref        string
+}
+
+// DeleteRepository forgets a ref and drops the documents of its commits, the
+// indexed and the pending one, unless another ref still uses them. It returns
+// the number of documents deleted.
+func DeleteRepository(ctx context.Context, input DeleteRepositoryInput) (int, error) {
+	conn, err := getConnection(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close(ctx)
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	var commit, pendingCommit string
+	err = tx.QueryRow(
+		ctx,
+		"DELETE FROM repositories WHERE repository=$1 AND ref=$2 RETURNING COALESCE(commit_sha, ''), COALESCE(pending_commit, '')",
+		input.Repository,
+		input.Ref,
+	).Scan(&commit, &pendingCommit)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("error deleting repository: %w", err)
+	}
+
+	deleted := 0
+	for _, c := range []string{commit, pendingCommit} {
+		if c == "" {
+			continue
+		}
+		tag, err := tx.Exec(ctx, deleteUnreferencedDocuments, input.Repository, c)
+		if err != nil {
+			return 0, fmt.Errorf("error deleting documents of commit %s: %w", c, err)
+		}
+		deleted += int(tag.RowsAffected())
+	}
+
+	return deleted, tx.Commit(ctx)
+}
@@ -0,0 +1,219 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"bitovi.com/code-analyzer/src/activities/llm"
+	"bitovi.com/code-analyzer/src/utils"
+	"github.com/jackc/pgx/v5"
+	"github.com/pgvector/pgvector-go"
+)
+
+const (
+	RetrievalVector  = "vector"
+	RetrievalLexical = "lexical"
+	RetrievalHybrid  = "hybrid"
+
+	// rrfK dampens the weight of the top ranks in reciprocal rank fusion; 60 is
+	// the value from the original paper.
+	rrfK = 60
+	// hybridCandidates is how many more candidates than requested each ranking
+	// contributes to the fusion.
+	hybridCandidates = 4
+	// exactSearchChunks is the size of the commits whose chunks are all
+	// compared with the query rather than searched through the vector index.
+	exactSearchChunks = 20000
+	// hnswEfSearch is how many neighbours the vector index collects before the
+	// documents of other commits are filtered out, the most pgvector allows.
+	hnswEfSearch = 1000
+)
+
+// The lexical index splits content on anything that is not a letter, digit
+// or underscore, so that identifiers such as db.GetRelatedDocuments match
+// their individual parts. Queries go through the same normalisation and any
+// of their terms may match.
+const lexicalQuery = "to_tsquery('simple', replace(plainto_tsquery('simple', regexp_replace($4, '[^[:alnum:]_]+', ' ', 'g'))::text, '&', '|'))"
+
+type GetRelatedDocumentsInput struct {
+	Repository string
+	Commit     string
+	Query      string
+	Limit      int
+	// Mode is one of RetrievalVector, RetrievalLexical or RetrievalHybrid,
+	// which is the default.
+	Mode string
+	// Filter restricts the documents ranked, before they are ranked.
+	Filter DocumentFilter
+}
+type GetRelatedDocumentsOutput struct {
+	Records []EmbeddingRecord
+}
+
+func GetRelatedDocuments(ctx context.Context, input GetRelatedDocumentsInput) (GetRelatedDocumentsOutput, error) {
+	mode := input.Mode
+	if mode == "" {
+		mode = RetrievalHybrid
+	}
+	if mode != RetrievalVector && mode != RetrievalLexical && mode != RetrievalHybrid {
+		return GetRelatedDocumentsOutput{}, utils.NonRetryableError(utils.ErrInvalidInput, fmt.Errorf("unknown retrieval mode %q", mode))
+	}
+
+	conn, err := getConnection(ctx)
+	if err != nil {
+		return GetRelatedDocumentsOutput{}, err
+	}
+	defer conn.Close(ctx)
+
+	model, err := llm.GetEmbeddingModel(ctx)
+	if err != nil {
+		return GetRelatedDocumentsOutput{}, err
+	}
+
+	// Rows of a commit whose ingestion has not finished may be incomplete, and
+	// rows embedded with another model cannot be compared with the query.
+	var chunks *int
+	err = conn.QueryRow(
+		ctx,
+		"SELECT MAX(chunks_indexed) FROM repositories WHERE repository=$1 AND commit_sha=$2 AND embedding_model=$3",
+		input.Repository,
+		input.Commit,
+		model,
+	).Scan(&chunks)
+	if err != nil {
+		return GetRelatedDocumentsOutput{}, fmt.Errorf("error checking repository status: %w", err)
+	}
+	if chunks == nil {
+		return GetRelatedDocumentsOutput{}, utils.NonRetryableError(utils.ErrNotReady, fmt.Errorf("%s is not indexed at commit %s yet", input.Repository, input.Commit))
+	}
+
+	candidates := input.Limit
+	if mode == RetrievalHybrid {
+		candidates = input.Limit * hybridCandidates
+	}
+
+	var vectorRecords, lexicalRecords []EmbeddingRecord
+	if mode != RetrievalLexical {
+		embeddingForQuery, err := llm.FetchEmbedding(input.Query)
+		if err != nil {
+			return GetRelatedDocumentsOutput{}, llm.ClassifyError(fmt.Errorf("error getting embeddings data for query %s: %w", input.Query, err))
+		}
+
+		// The vector index holds every commit and is searched before the
+		// other conditions apply, so it can return fewer rows than asked for.
+		// Filtered searches and small commits compare every chunk instead,
+		// and other searches widen the index search.
+		query := "SELECT key, start_line, end_line, start_offset, content, 1 - (embedding <=> $4) FROM documents WHERE repository=$1 AND commit_sha=$2 AND embedding_model=$3%s ORDER BY embedding <=> $4 LIMIT $5"
+		if !input.Filter.empty() || *chunks <= exactSearchChunks {
+			query = "WITH candidates AS MATERIALIZED (SELECT key, start_line, end_line, start_offset, content, embedding FROM documents WHERE repository=$1 AND commit_sha=$2 AND embedding_model=$3%s) " +
+				"SELECT key, start_line, end_line, start_offset, content, 1 - (embedding <=> $4) FROM candidates ORDER BY embedding <=> $4 LIMIT $5"
+		} else if _, err := conn.Exec(ctx, fmt.Sprintf("SET hnsw.ef_search = %d", hnswEfSearch)); err != nil {
+			return GetRelatedDocumentsOutput{}, fmt.Errorf("error configuring vector search: %w", err)
+		}
+
+		vectorRecords, err = queryDocuments(
+			ctx,
+			conn,
+			input,
+			model,
+			query,
+			pgvector.NewVector(embeddingForQuery),
+			candidates,
+		)
+		if err != nil {
+			return GetRelatedDocumentsOutput{}, err
+		}
+	}
+
+	if mode != RetrievalVector {
+		lexicalRecords, err = queryDocuments(
+			ctx,
+			conn,
+			input,
+			model,
+			"SELECT key, start_line, end_line, start_offset, content, ts_rank_cd(content_tsv, query) AS rank FROM documents, "+lexicalQuery+" query WHERE repository=$1 AND commit_sha=$2 AND embedding_model=$3%s AND content_tsv @@ query ORDER BY rank DESC LIMIT $5",
+			input.Query,
+			candidates,
+		)
+		if err != nil {
+			return GetRelatedDocumentsOutput{}, err
+		}
+	}
+
+	var relatedRecords []EmbeddingRecord
+	switch mode {
+	case RetrievalVector:
+		relatedRecords = vectorRecords
+	case RetrievalLexical:
+		relatedRecords = lexicalRecords
+	case RetrievalHybrid:
+		relatedRecords = fuseRankings(input.Limit, vectorRecords, lexicalRecords)
+	}
+
+	return GetRelatedDocumentsOutput{
+		Records: relatedRecords,
+	}, nil
+}
+
+// queryDocuments runs a ranking query over the documents a model embedded at
+// a commit. The query takes the repository, commit and model as $1 to $3,
+// followed by args, and has a %s where the conditions of the filter go.
+func queryDocuments(ctx context.Context, conn *pgx.Conn, input GetRelatedDocumentsInput, model string, query string, args ...any) ([]EmbeddingRecord, error) {
+	filter, filterArgs := input.Filter.where(len(args) + 4)
+	args = append(append([]any{input.Repository, input.Commit, model}, args...), filterArgs...)
+	rows, err := conn.Query(ctx, fmt.Sprintf(query, filter), args...)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching related documents: %w", err)
+	}
+	defer rows.Close()
+
+	var records []EmbeddingRecord
+	for rows.Next() {
+		doc := EmbeddingRecord{Repository: input.Repository, Commit: input.Commit}
+		err = rows.Scan(&doc.Key, &doc.StartLine, &doc.EndLine, &doc.Offset, &doc.Content, &doc.Score)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, doc)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error fetching related documents: %w", err)
+	}
+	return records, nil
+}
+
+// fuseRankings merges several rankings with reciprocal rank fusion: each
+// record scores the sum of 1/(rrfK+rank) over the rankings it appears in.
+func fuseRankings(limit int, rankings ...[]EmbeddingRecord) []EmbeddingRecord {
+	type chunkID struct {
+		key       string
+		startLine int
+		offset    int
+	}
+
+	var fused []EmbeddingRecord
+	positions := map[chunkID]int{}
+	for _, ranking := range rankings {
+		for rank, record := range ranking {
+			score := 1 / float64(rrfK+rank+1)
+			id := chunkID{record.Key, record.StartLine, record.Offset}
+			if i, ok := positions[id]; ok {
+				fused[i].Score += score
+				continue
+			}
+			positions[id] = len(fused)
+			record.Score = score
+			fused = append(fused, record)
+		}
+	}
+
+	sort.SliceStable(fused, func(i, j int) bool {
+		return fused[i].Score > fused[j].Score
+	})
+	if len(fused) > limit {
+		fused = fused[:limit]
+	}
+	return fused
+}
@@ -0,0 +1,80 @@
+package db
+
+import (
+	"math"
+	"testing"
+)
+
+func TestFuseRankings(t *testing.T) {
+	record := func(key string, startLine int, offset int) EmbeddingRecord {
+		return EmbeddingRecord{Key: key, StartLine: startLine, Offset: offset}
+	}
+	score := func(ranks ...int) float64 {
+		total := 0.0
+		for _, rank := range ranks {
+			total += 1 / float64(rrfK+rank)
+		}
+		return total
+	}
+
+	tests := []struct {
+		name     string
+		limit    int
+		rankings [][]EmbeddingRecord
+		want     []EmbeddingRecord
+		scores   []float64
+	}{
+		{
+			name:     "no rankings",
+			limit:    5,
+			rankings: nil,
+		},
+		{
+			name:  "records in both rankings come first",
+			limit: 5,
+			rankings: [][]EmbeddingRecord{
+				{record("a.go", 1, 0), record("b.go", 1, 0)},
+				{record("c.go", 1, 0), record("b.go", 1, 0)},
+			},
+			want:   []EmbeddingRecord{record("b.go", 1, 0), record("a.go", 1, 0), record("c.go", 1, 0)},
+			scores: []float64{score(2, 2), score(1), score(1)},
+		},
+		{
+			name:  "chunks of one line are told apart by their offset",
+			limit: 5,
+			rankings: [][]EmbeddingRecord{
+				{record("a.js", 1, 0), record("a.js", 1, 3000)},
+				{record("a.js", 1, 3000)},
+			},
+			want:   []EmbeddingRecord{record("a.js", 1, 3000), record("a.js", 1, 0)},
+			scores: []float64{score(2, 1), score(1)},
+		},
+		{
+			name:  "limit",
+			limit: 2,
+			rankings: [][]EmbeddingRecord{
+				{record("a.go", 1, 0), record("b.go", 1, 0), record("c.go", 1, 0)},
+			},
+			want:   []EmbeddingRecord{record("a.go", 1, 0), record("b.go", 1, 0)},
+			scores: []float64{score(1), score(2)},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fused := fuseRankings(test.limit, test.rankings...)
+			if len(fused) != len(test.want) {
+				t.Fatalf("got %d records, want %d", len(fused), len(test.want))
+			}
+			for i, record := range fused {
+				want := test.want[i]
+				if record.Key != want.Key || record.StartLine != want.StartLine || record.Offset != want.Offset {
+					t.Errorf("record %d is %s:%d+%d, want %s:%d+%d", i, record.Key, record.StartLine, record.Offset, want.Key, want.StartLine, want.Offset)
+				}
+				if math.Abs(record.Score-test.scores[i]) > 1e-12 {
+					t.Errorf("record %d scores %f, want %f", i, record.Score, test.scores[i])
+				}
+			}
+		})
+	}
+}
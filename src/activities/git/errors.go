@@ -0,0 +1,58 @@
+package git
+
+import (
+	"strings"
+
+	"bitovi.com/code-analyzer/src/utils"
+)
+
+var (
+	credentialErrors = []string{
+		"authentication failed",
+		"could not read username",
+		"could not read password",
+		"terminal prompts disabled",
+		"permission denied (publickey",
+		"host key verification failed",
+		"invalid username or password",
+		"access denied",
+	}
+	repositoryErrors = []string{
+		"repository not found",
+		"' not found",
+		"does not appear to be a git repository",
+		"unsupported protocol",
+		"is not a valid",
+	}
+	refErrors = []string{
+		"couldn't find remote ref",
+		"not our ref",
+	}
+)
+
+// classifyError turns the errors git reports for bad credentials, unknown
+// repositories and unknown refs into non-retryable errors. Anything else,
+// such as a network failure, is left to the retry policy.
+func classifyError(err error) error {
+	if err == nil || utils.IsNonRetryable(err) {
+		return err
+	}
+
+	message := strings.ToLower(err.Error())
+	for _, pattern := range credentialErrors {
+		if strings.Contains(message, pattern) {
+			return utils.NonRetryableError(utils.ErrBadCredentials, err)
+		}
+	}
+	for _, pattern := range refErrors {
+		if strings.Contains(message, pattern) {
+			return utils.NonRetryableError(utils.ErrInvalidRef, err)
+		}
+	}
+	for _, pattern := range repositoryErrors {
+		if strings.Contains(message, pattern) {
+			return utils.NonRetryableError(utils.ErrInvalidRepository, err)
+		}
+	}
+	return err
+}
@@ -1,84 +1,360 @@
 package git
 
 import (
+	"bytes"
+	"context"
 	"fmt"
-	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"bitovi.com/code-analyzer/src/activities/s3"
+	"bitovi.com/code-analyzer/src/credentials"
 	"bitovi.com/code-analyzer/src/utils"
+	"go.temporal.io/sdk/activity"
 )
 
+func runGit(dir string, env []string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), env...)
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("git %s: %w: %s", args[0], err, credentials.Redact(strings.TrimSpace(stderr.String())))
+	}
+	return stdout.String(), nil
+}
+
+const DefaultRef = "HEAD"
+
+var commitPattern = regexp.MustCompile("^[0-9a-fA-F]{40}$")
+
+func IsCommit(ref string) bool {
+	return commitPattern.MatchString(ref)
+}
+
+type ResolveCommitInput struct {
+	Repository string
+	Ref        string
+}
+
+func ResolveCommit(input ResolveCommitInput) (string, error) {
+	if err := validateInput(input.Repository, input.Ref); err != nil {
+		return "", err
+	}
+	ref := input.Ref
+	if ref == "" {
+		ref = DefaultRef
+	}
+	if IsCommit(ref) {
+		return strings.ToLower(ref), nil
+	}
+
+	env, cleanup, err := credentials.GitEnv(input.Repository)
+	defer cleanup()
+	if err != nil {
+		return "", utils.NonRetryableError(utils.ErrConfiguration, err)
+	}
+
+	out, err := runGit("", env, "ls-remote", "--", input.Repository, ref, ref+"^{}")
+	if err != nil {
+		return "", classifyError(err)
+	}
+
+	commits := map[string]string{}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 {
+			commits[fields[1]] = fields[0]
+		}
+	}
+
+	// Annotated tags are listed twice; the peeled "^{}" entry is the commit.
+	candidates := []string{
+		"refs/tags/" + ref + "^{}",
+		"refs/heads/" + ref,
+		"refs/tags/" + ref,
+		ref + "^{}",
+		ref,
+	}
+	for _, name := range candidates {
+		if commit, ok := commits[name]; ok {
+			return commit, nil
+		}
+	}
+	return "", utils.NonRetryableError(utils.ErrInvalidRef, fmt.Errorf("ref %s not found in %s", ref, credentials.Redact(input.Repository)))
+}
+
 type ArchiveRepositoryInput struct {
 	Repository string
 	Bucket     string
+	Ref        string
+	BaseCommit string
 }
+
+const (
+	// ManifestKey and DeletedManifestKey hold the files to index and the files
+	// removed since the base commit. Hidden files are never archived, so these
+	// keys cannot collide with a file of the repository.
+	ManifestKey        = ".manifest/changed"
+	DeletedManifestKey = ".manifest/deleted"
+
+	uploadConcurrency = 16
+)
+
 type ArchiveRepositoryOutput struct {
-	Keys []string
+	Commit             string
+	Incremental        bool
+	FileCount          int
+	DeletedCount       int
+	ManifestKey        string
+	DeletedManifestKey string
 }
 
-func ArchiveRepository(input ArchiveRepositoryInput) (ArchiveRepositoryOutput, error) {
-	temporaryDirectory := filepath.Join(os.TempDir(), utils.CleanRepository(input.Repository))
-	if err := os.MkdirAll(temporaryDirectory, os.ModePerm); err != nil {
+func ArchiveRepository(ctx context.Context, input ArchiveRepositoryInput) (ArchiveRepositoryOutput, error) {
+	if err := validateInput(input.Repository, input.Ref); err != nil {
 		return ArchiveRepositoryOutput{}, err
 	}
-	if err := os.RemoveAll(temporaryDirectory); err != nil {
+	if input.BaseCommit != "" && !IsCommit(input.BaseCommit) {
+		return ArchiveRepositoryOutput{}, utils.NonRetryableError(utils.ErrInvalidInput, fmt.Errorf("invalid base commit %q", input.BaseCommit))
+	}
+	ref := input.Ref
+	if ref == "" {
+		ref = DefaultRef
+	}
+
+	temporaryDirectory, err := os.MkdirTemp("", utils.CleanRepository(input.Repository)+"-")
+	if err != nil {
 		return ArchiveRepositoryOutput{}, err
 	}
+	defer os.RemoveAll(temporaryDirectory)
 
-	cmd := exec.Command("git", "clone", "--depth", "1", input.Repository, temporaryDirectory)
-	if err := cmd.Run(); err != nil {
+	env, cleanup, err := credentials.GitEnv(input.Repository)
+	defer cleanup()
+	if err != nil {
+		return ArchiveRepositoryOutput{}, utils.NonRetryableError(utils.ErrConfiguration, err)
+	}
+
+	var uploaded atomic.Int64
+	stop := keepAlive(ctx, &uploaded)
+	defer stop()
+
+	if err := checkout(temporaryDirectory, env, input.Repository, ref); err != nil {
+		return ArchiveRepositoryOutput{}, classifyError(err)
+	}
+
+	out, err := runGit(temporaryDirectory, env, "rev-parse", "HEAD")
+	if err != nil {
+		return ArchiveRepositoryOutput{}, err
+	}
+	commit := strings.TrimSpace(out)
+
+	var fileList, deletedKeys []string
+	incremental := false
+	if input.BaseCommit != "" {
+		fileList, deletedKeys, err = diffFiles(temporaryDirectory, env, input.BaseCommit, commit)
+		incremental = err == nil
+	}
+	if !incremental {
+		fileList, err = listFiles(temporaryDirectory)
+		if err != nil {
+			return ArchiveRepositoryOutput{}, err
+		}
+	}
+
+	var keys []string
+	for _, key := range fileList {
+		if utils.IsHiddenFile(key) || utils.IsConfigFile(key) || utils.IsImageFile(key) {
+			continue
+		}
+		keys = append(keys, key)
+	}
+
+	if err := uploadFiles(ctx, temporaryDirectory, input.Bucket, keys, &uploaded); err != nil {
 		return ArchiveRepositoryOutput{}, err
 	}
 
+	if err := s3.PutManifest(input.Bucket, ManifestKey, keys); err != nil {
+		return ArchiveRepositoryOutput{}, fmt.Errorf("error putting manifest in S3: %w", err)
+	}
+	if err := s3.PutManifest(input.Bucket, DeletedManifestKey, deletedKeys); err != nil {
+		return ArchiveRepositoryOutput{}, fmt.Errorf("error putting manifest in S3: %w", err)
+	}
+
+	return ArchiveRepositoryOutput{
+		Commit:             commit,
+		Incremental:        incremental,
+		FileCount:          len(keys),
+		DeletedCount:       len(deletedKeys),
+		ManifestKey:        ManifestKey,
+		DeletedManifestKey: DeletedManifestKey,
+	}, nil
+}
+
+// uploadFiles puts every file in the bucket under its key, several at a time,
+// counting the files uploaded so far in uploaded.
+func uploadFiles(ctx context.Context, directory string, bucket string, keys []string, uploaded *atomic.Int64) error {
+	jobs := make(chan string)
+	errs := make(chan error, uploadConcurrency)
+	var wg sync.WaitGroup
+
+	for i := 0; i < uploadConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range jobs {
+				data, err := os.ReadFile(filepath.Join(directory, key))
+				if err != nil {
+					errs <- fmt.Errorf("error reading %s: %w", key, err)
+					return
+				}
+				if err := s3.PutObject(bucket, key, data); err != nil {
+					errs <- fmt.Errorf("error putting object in S3 for %s: %w", key, err)
+					return
+				}
+				uploaded.Add(1)
+			}
+		}()
+	}
+
+	var err error
+send:
+	for _, key := range keys {
+		select {
+		case jobs <- key:
+		case err = <-errs:
+			break send
+		case <-ctx.Done():
+			err = ctx.Err()
+			break send
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if err == nil {
+		select {
+		case err = <-errs:
+		default:
+		}
+	}
+	return err
+}
+
+// keepAlive heartbeats every few seconds until stopped, since checking out and
+// uploading a large repository can take far longer than the heartbeat timeout.
+func keepAlive(ctx context.Context, uploaded *atomic.Int64) func() {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(5 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				activity.RecordHeartbeat(ctx, uploaded.Load())
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// validateInput rejects repositories and refs that git could mistake for
+// options, before they are passed to it.
+func validateInput(repository string, ref string) error {
+	if err := ValidateRepository(repository); err != nil {
+		return utils.NonRetryableError(utils.ErrInvalidRepository, err)
+	}
+	if err := ValidateRef(ref); err != nil {
+		return utils.NonRetryableError(utils.ErrInvalidRef, err)
+	}
+	if ref == "" || IsCommit(ref) {
+		return nil
+	}
+	if _, err := runGit("", nil, "check-ref-format", "--allow-onelevel", ref); err != nil {
+		return utils.NonRetryableError(utils.ErrInvalidRef, fmt.Errorf("invalid ref %q", ref))
+	}
+	return nil
+}
+
+// checkout fetches a single commit rather than cloning, so that branches, tags
+// and commit SHAs can all be checked out the same way.
+func checkout(directory string, env []string, repository string, ref string) error {
+	steps := [][]string{
+		{"init", "--quiet"},
+		{"remote", "add", "--", "origin", repository},
+		{"fetch", "--depth", "1", "--", "origin", ref},
+		{"checkout", "--quiet", "FETCH_HEAD"},
+	}
+	for _, args := range steps {
+		if _, err := runGit(directory, env, args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func listFiles(directory string) ([]string, error) {
 	var fileList []string
-	err := filepath.Walk(temporaryDirectory, func(path string, info os.FileInfo, err error) error {
+	err := filepath.Walk(directory, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
 		if info.IsDir() {
+			if info.Name() == ".git" {
+				return filepath.SkipDir
+			}
 			return nil
 		}
-		if utils.IsHiddenFile(path) || utils.IsConfigFile(path) || utils.IsImageFile(path) {
-			return nil
-		}
-		fileList = append(fileList, path)
+		fileList = append(fileList, strings.TrimPrefix(path, directory+"/"))
 
 		return nil
 	})
 	if err != nil {
-		return ArchiveRepositoryOutput{}, fmt.Errorf("error walking temporary directory: %w", err)
+		return nil, fmt.Errorf("error walking temporary directory: %w", err)
 	}
+	return fileList, nil
+}
 
-	var keys []string
-	for _, filePath := range fileList {
-		file, err := os.Open(filePath)
-		if err != nil {
-			return ArchiveRepositoryOutput{}, fmt.Errorf("error opening %s: %w", filePath, err)
-		}
-		defer file.Close()
+// diffFiles fetches baseCommit into the shallow clone and lists the files
+// added or modified since then, along with the files that were removed.
+func diffFiles(directory string, env []string, baseCommit string, commit string) ([]string, []string, error) {
+	if baseCommit == commit {
+		return nil, nil, nil
+	}
+	if _, err := runGit(directory, env, "fetch", "--depth", "1", "--", "origin", baseCommit); err != nil {
+		return nil, nil, err
+	}
 
-		data, err := io.ReadAll(file)
-		if err != nil {
-			return ArchiveRepositoryOutput{}, fmt.Errorf("error reading %s: %w", filePath, err)
-		}
+	out, err := runGit(directory, env, "diff", "--name-status", "--no-renames", "-z", baseCommit, commit)
+	if err != nil {
+		return nil, nil, err
+	}
+	changed, deleted := parseNameStatus(out)
+	return changed, deleted, nil
+}
 
-		key := strings.ReplaceAll(filePath, temporaryDirectory+"/", "")
-		err = s3.PutObject(
-			input.Bucket,
-			key,
-			data,
-		)
-		if err != nil {
-			return ArchiveRepositoryOutput{}, fmt.Errorf("error putting object in S3 for %s: %w", key, err)
+// parseNameStatus splits the output of git diff --name-status -z, which
+// alternates statuses and paths, each ending with a NUL. Paths are verbatim,
+// whereas without -z git quotes those with unusual characters.
+func parseNameStatus(out string) ([]string, []string) {
+	var changed, deleted []string
+	fields := strings.Split(strings.TrimSuffix(out, "\x00"), "\x00")
+	for i := 0; i+1 < len(fields); i += 2 {
+		if fields[i] == "D" {
+			deleted = append(deleted, fields[i+1])
+		} else {
+			changed = append(changed, fields[i+1])
 		}
-		keys = append(keys, key)
 	}
-
-	return ArchiveRepositoryOutput{
-		Keys: keys,
-	}, nil
+	return changed, deleted
 }
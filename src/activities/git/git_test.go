@@ -0,0 +1,109 @@
+package git
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseNameStatus(t *testing.T) {
+	tests := []struct {
+		name    string
+		out     string
+		changed []string
+		deleted []string
+	}{
+		{name: "no changes", out: ""},
+		{
+			name:    "added, modified and deleted",
+			out:     "A\x00new.go\x00M\x00src/main.go\x00D\x00old.go\x00",
+			changed: []string{"new.go", "src/main.go"},
+			deleted: []string{"old.go"},
+		},
+		{
+			name:    "unusual characters are not quoted",
+			out:     "M\x00caf\xc3\xa9 \"quoted\".txt\x00A\x00tab\there\x00D\x00new\nline\x00",
+			changed: []string{"caf\xc3\xa9 \"quoted\".txt", "tab\there"},
+			deleted: []string{"new\nline"},
+		},
+		{
+			name:    "type changes count as changes",
+			out:     "T\x00link\x00",
+			changed: []string{"link"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			changed, deleted := parseNameStatus(test.out)
+			if !reflect.DeepEqual(changed, test.changed) {
+				t.Errorf("changed = %q, want %q", changed, test.changed)
+			}
+			if !reflect.DeepEqual(deleted, test.deleted) {
+				t.Errorf("deleted = %q, want %q", deleted, test.deleted)
+			}
+		})
+	}
+}
+
+func TestValidateRepository(t *testing.T) {
+	tests := []struct {
+		repository string
+		valid      bool
+	}{
+		{"https://github.com/bitovi/example", true},
+		{"https://github.com/bitovi/example.git", true},
+		{"ssh://git@github.com:22/bitovi/example.git", true},
+		{"git@github.com:bitovi/example.git", true},
+		{"", false},
+		{"--upload-pack=touch /tmp/pwned", false},
+		{"-uhttps://github.com/bitovi/example", false},
+		{"http://github.com/bitovi/example", false},
+		{"file:///etc", false},
+		{"ext::sh -c touch% /tmp/pwned", false},
+		{"/tmp/repository", false},
+		{"https://-oProxyCommand=sh/example", false},
+		{"ssh://-oProxyCommand=sh/example", false},
+		{"git@-oProxyCommand=sh:example", false},
+		{"https://github.com/bitovi/example with spaces", false},
+	}
+
+	for _, test := range tests {
+		err := ValidateRepository(test.repository)
+		if (err == nil) != test.valid {
+			t.Errorf("ValidateRepository(%q) = %v, want valid %v", test.repository, err, test.valid)
+		}
+	}
+}
+
+func TestValidateRef(t *testing.T) {
+	tests := []struct {
+		ref   string
+		valid bool
+	}{
+		{"", true},
+		{"HEAD", true},
+		{"main", true},
+		{"feature/chunking", true},
+		{"refs/heads/main", true},
+		{"v1.2.3", true},
+		{"0123456789abcdef0123456789abcdef01234567", true},
+		{"-main", false},
+		{"--upload-pack=sh", false},
+		{"main..other", false},
+		{"main.lock", false},
+		{".hidden", false},
+		{"feature/", false},
+		{"feature//x", false},
+		{"main@{1}", false},
+		{"main~1", false},
+		{"a b", false},
+		{"a:b", false},
+	}
+
+	for _, test := range tests {
+		err := ValidateRef(test.ref)
+		if (err == nil) != test.valid {
+			t.Errorf("ValidateRef(%q) = %v, want valid %v", test.ref, err, test.valid)
+		}
+	}
+}
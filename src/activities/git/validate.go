@@ -0,0 +1,68 @@
+package git
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// scpPattern matches scp-like repository URLs, user@host:path. The host must
+// start with a letter or digit so that it cannot be read as an ssh option.
+var scpPattern = regexp.MustCompile(`^[A-Za-z0-9._~-]+@[A-Za-z0-9][A-Za-z0-9.-]*:[^\s]+$`)
+
+// ValidateRepository accepts https://, ssh:// and user@host:path repository
+// URLs only. Repositories end up as arguments to git, so anything else, such
+// as a value starting with "-", could be read as an option and run commands.
+func ValidateRepository(repository string) error {
+	if repository == "" {
+		return errors.New("a repository is required")
+	}
+	if strings.HasPrefix(repository, "-") || strings.IndexFunc(repository, isSpaceOrControl) >= 0 {
+		return fmt.Errorf("invalid repository %q", repository)
+	}
+
+	if strings.HasPrefix(repository, "https://") || strings.HasPrefix(repository, "ssh://") {
+		u, err := url.Parse(repository)
+		if err != nil || u.Hostname() == "" || strings.HasPrefix(u.Hostname(), "-") || strings.HasPrefix(u.User.Username(), "-") {
+			return fmt.Errorf("invalid repository %q", repository)
+		}
+		return nil
+	}
+	if scpPattern.MatchString(repository) {
+		return nil
+	}
+	return fmt.Errorf("repository %q must be an https://, ssh:// or user@host:path URL", repository)
+}
+
+// ValidateRef accepts the refs git check-ref-format --allow-onelevel does,
+// except those starting with "-", and commit SHAs. An empty ref stands for
+// DefaultRef.
+func ValidateRef(ref string) error {
+	if ref == "" || ref == DefaultRef || IsCommit(ref) {
+		return nil
+	}
+
+	invalid := strings.HasPrefix(ref, "-") ||
+		strings.HasPrefix(ref, "/") ||
+		strings.HasSuffix(ref, "/") ||
+		strings.HasSuffix(ref, ".") ||
+		ref == "@" ||
+		strings.Contains(ref, "..") ||
+		strings.Contains(ref, "//") ||
+		strings.Contains(ref, "@{") ||
+		strings.ContainsAny(ref, " ~^:?*[\\") ||
+		strings.IndexFunc(ref, isSpaceOrControl) >= 0
+	for _, component := range strings.Split(ref, "/") {
+		invalid = invalid || strings.HasPrefix(component, ".") || strings.HasSuffix(component, ".lock")
+	}
+	if invalid {
+		return fmt.Errorf("invalid ref %q", ref)
+	}
+	return nil
+}
+
+func isSpaceOrControl(r rune) bool {
+	return r <= ' ' || r == 0x7f
+}
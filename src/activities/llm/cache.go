@@ -0,0 +1,96 @@
+package llm
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"go.temporal.io/sdk/activity"
+)
+
+// EmbeddingCache stores embeddings by the hash of the text embedded and the
+// model that embedded it, which names the dimensions too. It is implemented by
+// the db package and installed by the worker with SetEmbeddingCache.
+type EmbeddingCache interface {
+	GetEmbeddings(ctx context.Context, model string, hashes []string) (map[string][]float32, error)
+	PutEmbeddings(ctx context.Context, model string, embeddings map[string][]float32) error
+}
+
+var embeddingCache EmbeddingCache
+
+func SetEmbeddingCache(cache EmbeddingCache) {
+	embeddingCache = cache
+}
+
+// ContentHash is the cache key of a text.
+func ContentHash(text string) string {
+	sum := sha256.Sum256([]byte(text))
+	return hex.EncodeToString(sum[:])
+}
+
+// fetchCachedEmbeddings embeds texts, reusing the cached embedding of any text
+// the current model has embedded before at the current dimensions. It returns
+// the embeddings and the number of texts found in the cache. The cache only
+// saves embedder calls, so failing to read or write it is logged rather than
+// failing the activity.
+func fetchCachedEmbeddings(ctx context.Context, texts []string) ([][]float32, int, error) {
+	if embeddingCache == nil || len(texts) == 0 {
+		embeddings, err := FetchEmbeddings(texts)
+		return embeddings, 0, err
+	}
+
+	embedder, err := GetEmbedder()
+	if err != nil {
+		return nil, 0, configurationError{err}
+	}
+	dimensions, err := GetEmbeddingDimensions()
+	if err != nil {
+		return nil, 0, configurationError{err}
+	}
+	model := fmt.Sprintf("%s/%d", embedder.Model(), dimensions)
+	logger := activity.GetLogger(ctx)
+
+	hashes := make([]string, len(texts))
+	for i, text := range texts {
+		hashes[i] = ContentHash(text)
+	}
+	cached, err := embeddingCache.GetEmbeddings(ctx, model, hashes)
+	if err != nil {
+		logger.Warn("Unable to read cached embeddings", "Error", err)
+		cached = nil
+	}
+
+	embeddings := make([][]float32, len(texts))
+	var missing []int
+	var missingTexts []string
+	queued := map[string]bool{}
+	for i, hash := range hashes {
+		if embedding, ok := cached[hash]; ok {
+			embeddings[i] = embedding
+		} else if !queued[hash] {
+			queued[hash] = true
+			missing = append(missing, i)
+			missingTexts = append(missingTexts, texts[i])
+		}
+	}
+
+	fetched, err := FetchEmbeddings(missingTexts)
+	if err != nil {
+		return nil, 0, err
+	}
+	fresh := make(map[string][]float32, len(fetched))
+	for n, i := range missing {
+		fresh[hashes[i]] = fetched[n]
+	}
+	for i, hash := range hashes {
+		if embeddings[i] == nil {
+			embeddings[i] = fresh[hash]
+		}
+	}
+
+	if err := embeddingCache.PutEmbeddings(ctx, model, fresh); err != nil {
+		logger.Warn("Unable to cache embeddings", "Error", err)
+	}
+	return embeddings, len(texts) - len(missing), nil
+}
@@ -0,0 +1,63 @@
+package llm
+
+import (
+	"fmt"
+	"strings"
+
+	"bitovi.com/code-analyzer/src/chunking"
+	"bitovi.com/code-analyzer/src/utils"
+)
+
+type ChatMessage struct {
+	Role    string
+	Content string
+}
+
+// SplitHistory keeps the most recent messages of a conversation that fit in
+// maxTokens, always in whole user/assistant pairs, and returns the older ones
+// separately so that they can be summarised.
+func SplitHistory(history []ChatMessage, maxTokens int) (older []ChatMessage, recent []ChatMessage) {
+	tokens := 0
+	start := len(history)
+	for start >= 2 {
+		pair := chunking.EstimateTokens(history[start-2].Content) + chunking.EstimateTokens(history[start-1].Content)
+		if tokens+pair > maxTokens {
+			break
+		}
+		tokens += pair
+		start -= 2
+	}
+	return history[:start], history[start:]
+}
+
+type SummarizeConversationInput struct {
+	Summary    string
+	Messages   []ChatMessage
+	Completion CompletionOptions
+}
+
+// SummarizeConversation folds messages into the running summary of a
+// conversation.
+func SummarizeConversation(input SummarizeConversationInput) (string, error) {
+	var transcript strings.Builder
+	for _, message := range input.Messages {
+		fmt.Fprintf(&transcript, "%s: %s\n\n", message.Role, message.Content)
+	}
+
+	prompt := [][]string{
+		{"system", "You summarise conversations between a user and a software assistant about a Git repository. Keep the questions asked, the files, functions and facts that were established, and anything the user said they care about. Answer with the summary only, in at most a few short paragraphs."},
+	}
+	if input.Summary != "" {
+		prompt = append(prompt, []string{"system", "Summary of the conversation so far: " + input.Summary})
+	}
+	prompt = append(prompt, []string{"user", "Update the summary with these messages:\n\n" + transcript.String()})
+
+	response, err := FetchCompletion(prompt, input.Completion)
+	if err != nil {
+		return "", ClassifyError(fmt.Errorf("error summarising conversation: %w", err))
+	}
+	if len(response.Choices) == 0 {
+		return "", utils.RetryableError(utils.ErrUpstream, fmt.Errorf("error summarising conversation: no choices returned"))
+	}
+	return response.Choices[0].Message.Content, nil
+}
@@ -0,0 +1,46 @@
+package llm
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSplitHistory(t *testing.T) {
+	// Each message of 30 characters counts as 10 tokens.
+	message := func(role string) ChatMessage {
+		return ChatMessage{Role: role, Content: strings.Repeat("m", 28)}
+	}
+	conversation := func(pairs int) []ChatMessage {
+		var history []ChatMessage
+		for i := 0; i < pairs; i++ {
+			history = append(history, message("user"), message("assistant"))
+		}
+		return history
+	}
+
+	tests := []struct {
+		name      string
+		history   []ChatMessage
+		maxTokens int
+		older     int
+		recent    int
+	}{
+		{name: "empty", history: nil, maxTokens: 100, older: 0, recent: 0},
+		{name: "everything fits", history: conversation(3), maxTokens: 60, older: 0, recent: 6},
+		{name: "older pairs are split off", history: conversation(3), maxTokens: 45, older: 2, recent: 4},
+		{name: "nothing fits", history: conversation(2), maxTokens: 15, older: 4, recent: 0},
+		{name: "a long pair keeps earlier ones out", history: append(conversation(2), message("user"), ChatMessage{Role: "assistant", Content: strings.Repeat("m", 300)}), maxTokens: 125, older: 4, recent: 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			older, recent := SplitHistory(test.history, test.maxTokens)
+			if len(older) != test.older || len(recent) != test.recent {
+				t.Errorf("split into %d older and %d recent messages, want %d and %d", len(older), len(recent), test.older, test.recent)
+			}
+			if len(recent) > 0 && recent[0].Role != "user" {
+				t.Errorf("recent messages start with a %s message", recent[0].Role)
+			}
+		})
+	}
+}
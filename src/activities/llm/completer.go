@@ -0,0 +1,257 @@
+package llm
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"bitovi.com/code-analyzer/src/utils/http"
+)
+
+const DefaultCompletionModel = "gpt-3.5-turbo"
+
+var (
+	CompleterKind         = os.Getenv("COMPLETER")
+	CompletionModel       = os.Getenv("COMPLETION_MODEL")
+	CompletionBaseURL     = os.Getenv("COMPLETION_BASE_URL")
+	CompletionAPIKey      = os.Getenv("COMPLETION_API_KEY")
+	CompletionTemperature = os.Getenv("COMPLETION_TEMPERATURE")
+	CompletionMaxTokens   = os.Getenv("COMPLETION_MAX_TOKENS")
+	CompletionScript      = os.Getenv("COMPLETION_SCRIPT")
+	CompletionStream      = os.Getenv("COMPLETION_STREAM")
+)
+
+// CompletionOptions override the configured completion settings for a single
+// request. Zero values keep the configured setting.
+type CompletionOptions struct {
+	Model       string
+	BaseURL     string
+	Temperature *float64
+	MaxTokens   int
+}
+
+type Completer interface {
+	Complete(messages []InvokeApiMessage, options CompletionOptions) (ChatCompletion, error)
+}
+
+// StreamingCompleter is a Completer that can also stream its completions,
+// calling onDelta with each piece of the response as it is generated.
+type StreamingCompleter interface {
+	Completer
+	CompleteStream(messages []InvokeApiMessage, options CompletionOptions, onDelta func(delta string)) (ChatCompletion, error)
+}
+
+var (
+	completerOnce sync.Once
+	completer     Completer
+	completerErr  error
+)
+
+// GetCompleter returns the completer selected by the COMPLETER environment
+// variable: "openai" (the default, for any OpenAI-compatible server) or
+// "scripted".
+func GetCompleter() (Completer, error) {
+	completerOnce.Do(func() {
+		completer, completerErr = NewCompleter(CompleterKind)
+	})
+	return completer, completerErr
+}
+
+func NewCompleter(kind string) (Completer, error) {
+	switch kind {
+	case "", "openai":
+		c := &OpenAICompleter{
+			BaseURL: CompletionBaseURL,
+			APIKey:  CompletionAPIKey,
+			Model:   CompletionModel,
+		}
+		if c.BaseURL == "" {
+			c.BaseURL = OpenAIBaseURL
+		}
+		if c.APIKey == "" {
+			c.APIKey = OpenAPIKey
+		}
+		if c.Model == "" {
+			c.Model = DefaultCompletionModel
+		}
+		if CompletionTemperature != "" {
+			t, err := strconv.ParseFloat(CompletionTemperature, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid COMPLETION_TEMPERATURE %q: %w", CompletionTemperature, err)
+			}
+			c.Temperature = &t
+		}
+		if CompletionMaxTokens != "" {
+			n, err := strconv.Atoi(CompletionMaxTokens)
+			if err != nil {
+				return nil, fmt.Errorf("invalid COMPLETION_MAX_TOKENS %q: %w", CompletionMaxTokens, err)
+			}
+			c.MaxTokens = n
+		}
+		return c, nil
+	case "scripted":
+		c := &ScriptedCompleter{}
+		if CompletionScript != "" {
+			data, err := os.ReadFile(CompletionScript)
+			if err != nil {
+				return nil, fmt.Errorf("error reading COMPLETION_SCRIPT: %w", err)
+			}
+			if err := json.Unmarshal(data, &c.Responses); err != nil {
+				return nil, fmt.Errorf("error parsing COMPLETION_SCRIPT: %w", err)
+			}
+		}
+		return c, nil
+	}
+	return nil, fmt.Errorf("unknown completer %q", kind)
+}
+
+type InvokeApiRequest struct {
+	Model       string             `json:"model"`
+	Messages    []InvokeApiMessage `json:"messages"`
+	Temperature *float64           `json:"temperature,omitempty"`
+	MaxTokens   int                `json:"max_tokens,omitempty"`
+	Stream      bool               `json:"stream,omitempty"`
+}
+
+// ChatCompletionChunk is one event of a streamed chat completion.
+type ChatCompletionChunk struct {
+	Choices []struct {
+		Delta Message `json:"delta"`
+	} `json:"choices"`
+}
+
+// OpenAICompleter calls the chat completions endpoint of OpenAI or of any
+// OpenAI-compatible server.
+type OpenAICompleter struct {
+	BaseURL     string
+	APIKey      string
+	Model       string
+	Temperature *float64
+	MaxTokens   int
+}
+
+func (c *OpenAICompleter) Complete(messages []InvokeApiMessage, options CompletionOptions) (ChatCompletion, error) {
+	url, data, apiKey := c.request(messages, options)
+
+	var result ChatCompletion
+	result, err := http.PostRequest(url, data, result, apiKey)
+	if err != nil {
+		return ChatCompletion{}, err
+	}
+
+	return result, nil
+}
+
+// CompleteStream requests a streamed completion, which the server sends as
+// server-sent events, each holding a chunk of the response, until [DONE].
+func (c *OpenAICompleter) CompleteStream(messages []InvokeApiMessage, options CompletionOptions, onDelta func(delta string)) (ChatCompletion, error) {
+	url, data, apiKey := c.request(messages, options)
+	data.Stream = true
+
+	var content strings.Builder
+	err := http.PostStream(url, data, apiKey, func(line string) error {
+		payload, ok := strings.CutPrefix(line, "data:")
+		payload = strings.TrimSpace(payload)
+		if !ok || payload == "" || payload == "[DONE]" {
+			return nil
+		}
+
+		var chunk ChatCompletionChunk
+		if err := json.Unmarshal([]byte(payload), &chunk); err != nil {
+			return fmt.Errorf("error parsing completion chunk: %w", err)
+		}
+		for _, choice := range chunk.Choices {
+			if choice.Delta.Content != "" {
+				content.WriteString(choice.Delta.Content)
+				onDelta(choice.Delta.Content)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return ChatCompletion{}, err
+	}
+
+	return ChatCompletion{
+		Choices: []Choice{{Message: Message{Content: content.String()}}},
+	}, nil
+}
+
+func (c *OpenAICompleter) request(messages []InvokeApiMessage, options CompletionOptions) (string, InvokeApiRequest, string) {
+	data := InvokeApiRequest{
+		Model:       c.Model,
+		Messages:    messages,
+		Temperature: c.Temperature,
+		MaxTokens:   c.MaxTokens,
+	}
+	if options.Model != "" {
+		data.Model = options.Model
+	}
+	if options.Temperature != nil {
+		data.Temperature = options.Temperature
+	}
+	if options.MaxTokens > 0 {
+		data.MaxTokens = options.MaxTokens
+	}
+
+	// The configured API key is only ever sent to the configured server, never
+	// to a base URL that arrived with a request.
+	baseURL, apiKey := c.BaseURL, c.APIKey
+	if options.BaseURL != "" && options.BaseURL != c.BaseURL {
+		baseURL, apiKey = options.BaseURL, ""
+	}
+
+	return strings.TrimSuffix(baseURL, "/") + "/chat/completions", data, apiKey
+}
+
+// ScriptedCompleter is a fake completer for tests. It replies with Responses
+// in order, starting over once they run out, or echoes the last user message
+// when it has no responses.
+type ScriptedCompleter struct {
+	Responses []string
+
+	mu   sync.Mutex
+	next int
+}
+
+func (c *ScriptedCompleter) Complete(messages []InvokeApiMessage, options CompletionOptions) (ChatCompletion, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var content string
+	if len(c.Responses) > 0 {
+		content = c.Responses[c.next%len(c.Responses)]
+		c.next++
+	} else {
+		for _, m := range messages {
+			if m.Role == "user" {
+				content = "You asked: " + m.Content
+			}
+		}
+	}
+
+	return ChatCompletion{
+		Choices: []Choice{{Message: Message{Content: content}}},
+	}, nil
+}
+
+// CompleteStream streams the scripted response one word at a time.
+func (c *ScriptedCompleter) CompleteStream(messages []InvokeApiMessage, options CompletionOptions, onDelta func(delta string)) (ChatCompletion, error) {
+	completion, err := c.Complete(messages, options)
+	if err != nil {
+		return ChatCompletion{}, err
+	}
+	content := completion.Choices[0].Message.Content
+	for len(content) > 0 {
+		end := strings.IndexByte(content[1:], ' ') + 1
+		if end == 0 {
+			end = len(content)
+		}
+		onDelta(content[:end])
+		content = content[end:]
+	}
+	return completion, nil
+}
@@ -0,0 +1,286 @@
+package llm
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	"bitovi.com/code-analyzer/src/utils/http"
+)
+
+const (
+	OpenAIBaseURL          = "https://api.openai.com/v1"
+	DefaultEmbeddingModel  = "text-embedding-3-small"
+	DefaultEmbeddingLength = 1536
+
+	// The OpenAI embeddings endpoint accepts up to 2048 inputs and 300k tokens
+	// per request. The defaults stay well below both, since token counts are
+	// only estimated.
+	DefaultEmbeddingBatchSize   = 256
+	DefaultEmbeddingBatchTokens = 100000
+)
+
+var (
+	EmbedderKind         = os.Getenv("EMBEDDER")
+	EmbeddingModel       = os.Getenv("EMBEDDING_MODEL")
+	EmbeddingBaseURL     = os.Getenv("EMBEDDING_BASE_URL")
+	EmbeddingAPIKey      = os.Getenv("EMBEDDING_API_KEY")
+	EmbeddingDimensions  = os.Getenv("EMBEDDING_DIMENSIONS")
+	EmbeddingBatchSize   = os.Getenv("EMBEDDING_BATCH_SIZE")
+	EmbeddingBatchTokens = os.Getenv("EMBEDDING_BATCH_TOKENS")
+)
+
+// Embedder turns text into a vector. Every implementation must return vectors
+// of the dimension the documents table was created with. EmbedBatch returns
+// one vector per text, in the same order.
+type Embedder interface {
+	Model() string
+	Embed(text string) ([]float32, error)
+	EmbedBatch(texts []string) ([][]float32, error)
+}
+
+var (
+	embedderOnce sync.Once
+	embedder     Embedder
+	embedderErr  error
+)
+
+// GetEmbedder returns the embedder selected by the EMBEDDER environment
+// variable: "openai" (the default), "openai-compatible" or "hash".
+func GetEmbedder() (Embedder, error) {
+	embedderOnce.Do(func() {
+		embedder, embedderErr = NewEmbedder(EmbedderKind)
+	})
+	return embedder, embedderErr
+}
+
+// GetEmbeddingDimensions returns the length of the vectors every embedder
+// returns: EMBEDDING_DIMENSIONS, or DefaultEmbeddingLength when it is unset.
+func GetEmbeddingDimensions() (int, error) {
+	if EmbeddingDimensions == "" {
+		return DefaultEmbeddingLength, nil
+	}
+	d, err := strconv.Atoi(EmbeddingDimensions)
+	if err != nil || d < 1 {
+		return 0, fmt.Errorf("invalid EMBEDDING_DIMENSIONS %q, expected a positive number", EmbeddingDimensions)
+	}
+	return d, nil
+}
+
+func NewEmbedder(kind string) (Embedder, error) {
+	dimensions, err := GetEmbeddingDimensions()
+	if err != nil {
+		return nil, err
+	}
+
+	apiKey := EmbeddingAPIKey
+	if apiKey == "" {
+		apiKey = OpenAPIKey
+	}
+
+	switch kind {
+	case "", "openai":
+		model := EmbeddingModel
+		if model == "" {
+			model = DefaultEmbeddingModel
+		}
+		return &OpenAIEmbedder{
+			APIKey:     apiKey,
+			ModelName:  model,
+			Dimensions: dimensions,
+		}, nil
+	case "openai-compatible":
+		if EmbeddingBaseURL == "" || EmbeddingModel == "" {
+			return nil, fmt.Errorf("EMBEDDING_BASE_URL and EMBEDDING_MODEL are required for the openai-compatible embedder")
+		}
+		return &OpenAICompatibleEmbedder{
+			BaseURL:    EmbeddingBaseURL,
+			APIKey:     EmbeddingAPIKey,
+			ModelName:  EmbeddingModel,
+			Dimensions: dimensions,
+		}, nil
+	case "hash":
+		return &HashEmbedder{
+			Dimensions: dimensions,
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown embedder %q", kind)
+}
+
+type FetchEmbeddingsApiRequest struct {
+	Input      []string `json:"input"`
+	Model      string   `json:"model"`
+	Dimensions int      `json:"dimensions,omitempty"`
+}
+
+type EmbeddingResponse struct {
+	Data []struct {
+		Index     int
+		Embedding []float32
+	}
+}
+
+func postEmbedding(baseURL string, apiKey string, data FetchEmbeddingsApiRequest, dimensions int) ([][]float32, error) {
+	var result EmbeddingResponse
+	result, err := http.PostRequest(strings.TrimSuffix(baseURL, "/")+"/embeddings", data, result, apiKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Data) != len(data.Input) {
+		return nil, fmt.Errorf("%s returned %d embeddings for %d inputs", baseURL, len(result.Data), len(data.Input))
+	}
+
+	embeddings := make([][]float32, len(data.Input))
+	for _, d := range result.Data {
+		if d.Index < 0 || d.Index >= len(embeddings) || embeddings[d.Index] != nil {
+			return nil, fmt.Errorf("%s returned an unexpected embedding index %d", baseURL, d.Index)
+		}
+		if dimensions > 0 && len(d.Embedding) != dimensions {
+			return nil, fmt.Errorf("%s returned %d dimensions, expected %d", data.Model, len(d.Embedding), dimensions)
+		}
+		embeddings[d.Index] = d.Embedding
+	}
+	return embeddings, nil
+}
+
+func embedOne(e Embedder, text string) ([]float32, error) {
+	embeddings, err := e.EmbedBatch([]string{text})
+	if err != nil {
+		return nil, err
+	}
+	return embeddings[0], nil
+}
+
+// OpenAIEmbedder calls the OpenAI embeddings API. The text-embedding-3 models
+// are asked for exactly Dimensions dimensions.
+type OpenAIEmbedder struct {
+	APIKey     string
+	ModelName  string
+	Dimensions int
+}
+
+func (e *OpenAIEmbedder) Model() string {
+	return e.ModelName
+}
+
+func (e *OpenAIEmbedder) Embed(text string) ([]float32, error) {
+	return embedOne(e, text)
+}
+
+func (e *OpenAIEmbedder) EmbedBatch(texts []string) ([][]float32, error) {
+	data := FetchEmbeddingsApiRequest{
+		Input: texts,
+		Model: e.ModelName,
+	}
+	if strings.HasPrefix(e.ModelName, "text-embedding-3") {
+		data.Dimensions = e.Dimensions
+	}
+	return postEmbedding(OpenAIBaseURL, e.APIKey, data, e.Dimensions)
+}
+
+// OpenAICompatibleEmbedder calls any server implementing the OpenAI
+// embeddings endpoint, such as Ollama (http://localhost:11434/v1) or vLLM.
+type OpenAICompatibleEmbedder struct {
+	BaseURL    string
+	APIKey     string
+	ModelName  string
+	Dimensions int
+}
+
+func (e *OpenAICompatibleEmbedder) Model() string {
+	return e.ModelName
+}
+
+func (e *OpenAICompatibleEmbedder) Embed(text string) ([]float32, error) {
+	return embedOne(e, text)
+}
+
+func (e *OpenAICompatibleEmbedder) EmbedBatch(texts []string) ([][]float32, error) {
+	data := FetchEmbeddingsApiRequest{
+		Input: texts,
+		Model: e.ModelName,
+	}
+	return postEmbedding(e.BaseURL, e.APIKey, data, e.Dimensions)
+}
+
+// HashEmbedder is a deterministic, offline embedder based on feature hashing.
+// Identifiers are split on case and punctuation, each token is hashed into
+// one of Dimensions buckets and the vector is L2-normalised. It has no notion
+// of meaning, but texts sharing identifiers end up close together, which is
+// enough to exercise the whole pipeline in CI or air-gapped environments.
+type HashEmbedder struct {
+	Dimensions int
+}
+
+func (e *HashEmbedder) Model() string {
+	return fmt.Sprintf("hash-%d", e.Dimensions)
+}
+
+func (e *HashEmbedder) Embed(text string) ([]float32, error) {
+	vector := make([]float32, e.Dimensions)
+	for _, token := range hashTokens(text) {
+		h := fnv.New64a()
+		h.Write([]byte(token))
+		sum := h.Sum64()
+
+		sign := float32(1)
+		if sum>>63 == 1 {
+			sign = -1
+		}
+		vector[sum%uint64(e.Dimensions)] += sign
+	}
+
+	var norm float64
+	for _, v := range vector {
+		norm += float64(v * v)
+	}
+	if norm > 0 {
+		scale := float32(1 / math.Sqrt(norm))
+		for i := range vector {
+			vector[i] *= scale
+		}
+	}
+	return vector, nil
+}
+
+func (e *HashEmbedder) EmbedBatch(texts []string) ([][]float32, error) {
+	embeddings := make([][]float32, len(texts))
+	for i, text := range texts {
+		embeddings[i], _ = e.Embed(text)
+	}
+	return embeddings, nil
+}
+
+// hashTokens lowercases words and also emits the parts of camelCase and
+// snake_case identifiers, so that "FetchEmbedding" matches "fetch embedding".
+func hashTokens(text string) []string {
+	words := strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_'
+	})
+
+	var tokens []string
+	for _, word := range words {
+		tokens = append(tokens, strings.ToLower(word))
+
+		var parts []string
+		start := 0
+		runes := []rune(word)
+		for i := 1; i <= len(runes); i++ {
+			if i == len(runes) || runes[i] == '_' || (unicode.IsUpper(runes[i]) && unicode.IsLower(runes[i-1])) {
+				if part := strings.Trim(string(runes[start:i]), "_"); part != "" {
+					parts = append(parts, strings.ToLower(part))
+				}
+				start = i
+			}
+		}
+		if len(parts) > 1 {
+			tokens = append(tokens, parts...)
+		}
+	}
+	return tokens
+}
@@ -0,0 +1,47 @@
+package llm
+
+import (
+	"errors"
+
+	"bitovi.com/code-analyzer/src/utils"
+	"bitovi.com/code-analyzer/src/utils/http"
+)
+
+// configurationError wraps the errors of GetEmbedder and GetCompleter, which
+// no retry can fix.
+type configurationError struct {
+	error
+}
+
+func (e configurationError) Unwrap() error {
+	return e.error
+}
+
+// ClassifyError tells permanent failures of the embeddings and completions
+// endpoints, such as a rejected API key or an invalid request, from
+// transient ones such as rate limiting or server errors.
+func ClassifyError(err error) error {
+	if err == nil || utils.ErrorType(err) != "" {
+		return err
+	}
+
+	var configErr configurationError
+	if errors.As(err, &configErr) {
+		return utils.NonRetryableError(utils.ErrConfiguration, err)
+	}
+
+	var statusErr *http.StatusError
+	if errors.As(err, &statusErr) {
+		switch {
+		case statusErr.StatusCode == 401 || statusErr.StatusCode == 403:
+			return utils.NonRetryableError(utils.ErrBadCredentials, err)
+		case statusErr.StatusCode == 429:
+			return utils.RetryableError(utils.ErrRateLimited, err)
+		case statusErr.StatusCode >= 500:
+			return utils.RetryableError(utils.ErrUpstream, err)
+		case statusErr.StatusCode >= 400:
+			return utils.NonRetryableError(utils.ErrInvalidInput, err)
+		}
+	}
+	return err
+}
@@ -1,75 +1,173 @@
 package llm
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"bitovi.com/code-analyzer/src/activities/s3"
-	"bitovi.com/code-analyzer/src/utils/http"
+	"bitovi.com/code-analyzer/src/chunking"
+	"bitovi.com/code-analyzer/src/utils"
+	"go.temporal.io/sdk/activity"
 )
 
 var OpenAPIKey string = os.Getenv("OPENAI_API_KEY")
 
-type GetEmbeddingDataInput struct {
-	Bucket string
-	Key    string
+// EmbeddedChunk is a chunking.Chunk with its embedding.
+type EmbeddedChunk struct {
+	StartLine int
+	EndLine   int
+	Offset    int
+	Content   string
+	Embedding []float32
 }
 
 type GetEmbeddingDataOutput struct {
-	Key       string
-	Embedding []float32
+	Key    string
+	Chunks []EmbeddedChunk
 }
 
-func GetEmbeddingData(input GetEmbeddingDataInput) (GetEmbeddingDataOutput, error) {
-	body, err := s3.GetObject(
-		input.Bucket,
-		input.Key,
-	)
-	if err != nil {
-		return GetEmbeddingDataOutput{}, fmt.Errorf("error fetching %s from S3 bucket: %w", input.Key, err)
+type GetEmbeddingDataBatchInput struct {
+	Bucket string
+	Keys   []string
+}
+type GetEmbeddingDataBatchOutput struct {
+	// Files holds the embedded chunks of each key, in the order of Keys.
+	Files []GetEmbeddingDataOutput
+	// CachedChunks counts the chunks whose embedding came from the cache.
+	CachedChunks int
+}
+
+// GetEmbeddingDataBatch chunks several files and embeds all of their chunks
+// with as few requests to the embedder as FetchEmbeddings can manage, skipping
+// chunks found in the embedding cache.
+func GetEmbeddingDataBatch(ctx context.Context, input GetEmbeddingDataBatchInput) (GetEmbeddingDataBatchOutput, error) {
+	type chunkRef struct {
+		file  int
+		chunk int
 	}
 
-	result, err := FetchEmbedding(string(body))
-	if err != nil {
-		if strings.Contains(err.Error(), "maximum context length") {
-			return GetEmbeddingDataOutput{}, nil
+	files := make([]GetEmbeddingDataOutput, len(input.Keys))
+	var texts []string
+	var refs []chunkRef
+	for i, key := range input.Keys {
+		body, err := s3.GetObject(input.Bucket, key)
+		if err != nil {
+			return GetEmbeddingDataBatchOutput{}, fmt.Errorf("error fetching %s from S3 bucket: %w", key, err)
+		}
+
+		chunks := chunking.Split(key, body)
+		files[i] = GetEmbeddingDataOutput{
+			Key:    key,
+			Chunks: make([]EmbeddedChunk, len(chunks)),
 		}
-		return GetEmbeddingDataOutput{}, fmt.Errorf("error getting embeddings data for %s: %w", input.Key, err)
+		for j, chunk := range chunks {
+			files[i].Chunks[j] = EmbeddedChunk{
+				StartLine: chunk.StartLine,
+				EndLine:   chunk.EndLine,
+				Offset:    chunk.Offset,
+				Content:   chunk.Content,
+			}
+			// Only the content is embedded, so that a chunk moved to
+			// another line or file reuses its cached embedding. The lexical
+			// index covers the path.
+			texts = append(texts, chunk.Content)
+			refs = append(refs, chunkRef{file: i, chunk: j})
+		}
+	}
+
+	embeddings, cached, err := fetchCachedEmbeddings(ctx, texts)
+	if err != nil {
+		return GetEmbeddingDataBatchOutput{}, ClassifyError(fmt.Errorf("error getting embeddings data for %d files from %s: %w", len(input.Keys), input.Keys[0], err))
+	}
+	for n, embedding := range embeddings {
+		files[refs[n].file].Chunks[refs[n].chunk].Embedding = embedding
 	}
 
-	return GetEmbeddingDataOutput{
-		Key:       input.Key,
-		Embedding: result,
+	return GetEmbeddingDataBatchOutput{
+		Files:        files,
+		CachedChunks: cached,
 	}, nil
 }
 
-type FetchEmbeddingsApiRequest struct {
-	Input string `json:"input"`
-	Model string `json:"model"`
+// GetEmbeddingModel returns the model of the configured embedder. Documents
+// embedded with any other model cannot be searched with it.
+func GetEmbeddingModel(ctx context.Context) (string, error) {
+	embedder, err := GetEmbedder()
+	if err != nil {
+		return "", ClassifyError(configurationError{err})
+	}
+	return embedder.Model(), nil
 }
 
-type EmbeddingResponse struct {
-	Data []struct {
-		Embedding []float32
+func FetchEmbedding(text string) ([]float32, error) {
+	embedder, err := GetEmbedder()
+	if err != nil {
+		return []float32{}, configurationError{err}
 	}
+
+	return embedder.Embed(text)
 }
 
-func FetchEmbedding(text string) ([]float32, error) {
-	url := "https://api.openai.com/v1/embeddings"
+// FetchEmbeddings embeds texts in as few requests as possible, each holding at
+// most EMBEDDING_BATCH_SIZE texts and EMBEDDING_BATCH_TOKENS estimated tokens.
+func FetchEmbeddings(texts []string) ([][]float32, error) {
+	embedder, err := GetEmbedder()
+	if err != nil {
+		return nil, configurationError{err}
+	}
+	maxSize, maxTokens, err := embeddingBatchLimits()
+	if err != nil {
+		return nil, configurationError{err}
+	}
 
-	data := &FetchEmbeddingsApiRequest{
-		Input: text,
-		Model: "text-embedding-3-small",
+	embeddings := make([][]float32, 0, len(texts))
+	for start := 0; start < len(texts); {
+		end := start
+		tokens := 0
+		for end < len(texts) && end-start < maxSize {
+			t := chunking.EstimateTokens(texts[end])
+			if end > start && tokens+t > maxTokens {
+				break
+			}
+			tokens += t
+			end++
+		}
+
+		batch, err := embedder.EmbedBatch(texts[start:end])
+		if err != nil {
+			return nil, err
+		}
+		embeddings = append(embeddings, batch...)
+		start = end
 	}
+	return embeddings, nil
+}
 
-	var result EmbeddingResponse
-	result, err := http.PostRequest(url, data, result, OpenAPIKey)
-	if err != nil {
-		return []float32{}, err
+func embeddingBatchLimits() (int, int, error) {
+	size := DefaultEmbeddingBatchSize
+	if EmbeddingBatchSize != "" {
+		s, err := strconv.Atoi(EmbeddingBatchSize)
+		if err != nil || s < 1 {
+			return 0, 0, fmt.Errorf("invalid EMBEDDING_BATCH_SIZE %q", EmbeddingBatchSize)
+		}
+		size = s
 	}
 
-	return result.Data[0].Embedding, nil
+	tokens := DefaultEmbeddingBatchTokens
+	if EmbeddingBatchTokens != "" {
+		t, err := strconv.Atoi(EmbeddingBatchTokens)
+		if err != nil || t < 1 {
+			return 0, 0, fmt.Errorf("invalid EMBEDDING_BATCH_TOKENS %q", EmbeddingBatchTokens)
+		}
+		tokens = t
+	}
+	return size, tokens, nil
 }
 
 type ChatCompletion struct {
@@ -83,19 +181,43 @@ type Choice struct {
 type Message struct {
 	Content string `json:"content"`
 }
-type InvokeApiRequest struct {
-	Model    string             `json:"model"`
-	Messages []InvokeApiMessage `json:"messages"`
-}
 
 type InvokeApiMessage struct {
 	Role    string `json:"role"`
 	Content string `json:"content"`
 }
 
-func FetchCompletion(input [][]string) (ChatCompletion, error) {
-	url := "https://api.openai.com/v1/chat/completions"
+func FetchCompletion(input [][]string, options CompletionOptions) (ChatCompletion, error) {
+	completer, err := GetCompleter()
+	if err != nil {
+		return ChatCompletion{}, configurationError{err}
+	}
+
+	return completer.Complete(newMessages(input), options)
+}
+
+// FetchCompletionStream is FetchCompletion calling onDelta with each piece of
+// the response as it is generated. Completers that cannot stream, or
+// COMPLETION_STREAM=false, deliver the whole response in a single delta.
+func FetchCompletionStream(input [][]string, options CompletionOptions, onDelta func(delta string)) (ChatCompletion, error) {
+	completer, err := GetCompleter()
+	if err != nil {
+		return ChatCompletion{}, configurationError{err}
+	}
+
+	messages := newMessages(input)
+	if streamer, ok := completer.(StreamingCompleter); ok && CompletionStream != "false" {
+		return streamer.CompleteStream(messages, options, onDelta)
+	}
+
+	completion, err := completer.Complete(messages, options)
+	if err == nil && len(completion.Choices) > 0 {
+		onDelta(completion.Choices[0].Message.Content)
+	}
+	return completion, err
+}
 
+func newMessages(input [][]string) []InvokeApiMessage {
 	messages := make([]InvokeApiMessage, len(input))
 	for i, p := range input {
 		messages[i] = InvokeApiMessage{
@@ -103,35 +225,117 @@ func FetchCompletion(input [][]string) (ChatCompletion, error) {
 			Content: p[1],
 		}
 	}
+	return messages
+}
 
-	data := InvokeApiRequest{
-		Model:    "gpt-3.5-turbo",
-		Messages: messages,
-	}
-
-	var result ChatCompletion
-	result, err := http.PostRequest(url, data, result, OpenAPIKey)
-	if err != nil {
-		return ChatCompletion{}, err
-	}
-
-	return result, nil
+type Source struct {
+	Key       string
+	StartLine int
+	EndLine   int
+	Content   string
 }
 
 type InvokePromptInput struct {
-	Query          string
-	RelatedContent []string
+	Query   string
+	Sources []Source
+	// Summary and History carry an ongoing conversation: a summary of its
+	// older turns and the most recent messages, oldest first.
+	Summary    string
+	History    []ChatMessage
+	Completion CompletionOptions
+}
+type InvokePromptOutput struct {
+	Response string
+	// Cited holds the indexes into Sources of the snippets the answer cites.
+	Cited []int
 }
 
-func InvokePrompt(input InvokePromptInput) (string, error) {
+// PartialResponse is the heartbeat detail of InvokePrompt: the response
+// generated so far, which clients poll to stream the answer.
+type PartialResponse struct {
+	Text string
+}
+
+// partialResponseInterval is how often InvokePrompt heartbeats the response
+// generated so far.
+const partialResponseInterval = 250 * time.Millisecond
+
+var citationPattern = regexp.MustCompile(`\[(\d+)\]`)
+
+func InvokePrompt(ctx context.Context, input InvokePromptInput) (InvokePromptOutput, error) {
+	snippets := make([]string, len(input.Sources))
+	for i, source := range input.Sources {
+		snippets[i] = fmt.Sprintf("[%d] %s (lines %d-%d)\n```\n%s\n```", i+1, source.Key, source.StartLine, source.EndLine, source.Content)
+	}
+
 	prompt := [][]string{
 		{"system", "You are a friendly, helpful software assistant. Your goal is to help users understand the code within a Git repository."},
 		{"system", "You should respond in short paragraphs, using Markdown formatting for any blocks of code, separated with two newlines to keep your responses easily readable."},
 		{"system", "Whenever possible, use code examples derived from the documentation provided."},
-		{"system", "Here are the files from the Git repository that are relevant to the user's question: " + strings.Join(input.RelatedContent, "\n\n")},
-		{"user", input.Query},
 	}
+	if input.Summary != "" {
+		prompt = append(prompt, []string{"system", "Here is a summary of the earlier conversation with the user: " + input.Summary})
+	}
+	for _, message := range input.History {
+		prompt = append(prompt, []string{message.Role, message.Content})
+	}
+	prompt = append(prompt,
+		[]string{"system", "Each snippet below is labelled with a number, its file path and its line range. When you rely on a snippet, cite it with its number in square brackets, for example [1]."},
+		[]string{"system", "Here are the snippets from the Git repository that are relevant to the user's question:\n\n" + strings.Join(snippets, "\n\n")},
+		[]string{"user", input.Query},
+	)
+
+	// The heartbeats also keep the activity alive while a long response is
+	// generated, streamed or not.
+	var mu sync.Mutex
+	var partial strings.Builder
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(partialResponseInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				mu.Lock()
+				text := partial.String()
+				mu.Unlock()
+				activity.RecordHeartbeat(ctx, PartialResponse{Text: text})
+			}
+		}
+	}()
 
-	invokeResponse, _ := FetchCompletion(prompt)
-	return invokeResponse.Choices[0].Message.Content, nil
+	invokeResponse, err := FetchCompletionStream(prompt, input.Completion, func(delta string) {
+		mu.Lock()
+		partial.WriteString(delta)
+		mu.Unlock()
+	})
+	if err != nil {
+		return InvokePromptOutput{}, ClassifyError(fmt.Errorf("error getting completion: %w", err))
+	}
+	if len(invokeResponse.Choices) == 0 {
+		return InvokePromptOutput{}, utils.RetryableError(utils.ErrUpstream, fmt.Errorf("error getting completion: no choices returned"))
+	}
+	response := invokeResponse.Choices[0].Message.Content
+
+	return InvokePromptOutput{
+		Response: response,
+		Cited:    parseCitations(response, len(input.Sources)),
+	}, nil
+}
+
+func parseCitations(response string, sources int) []int {
+	seen := map[int]bool{}
+	var cited []int
+	for _, match := range citationPattern.FindAllStringSubmatch(response, -1) {
+		n, err := strconv.Atoi(match[1])
+		if err != nil || n < 1 || n > sources || seen[n-1] {
+			continue
+		}
+		seen[n-1] = true
+		cited = append(cited, n-1)
+	}
+	return cited
 }
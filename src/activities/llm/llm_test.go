@@ -0,0 +1,30 @@
+package llm
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseCitations(t *testing.T) {
+	tests := []struct {
+		name     string
+		response string
+		sources  int
+		cited    []int
+	}{
+		{name: "no citations", response: "The answer.", sources: 3},
+		{name: "in order of first citation", response: "See [2], then [1] and [2] again.", sources: 3, cited: []int{1, 0}},
+		{name: "out of range", response: "See [0], [4] and [3].", sources: 3, cited: []int{2}},
+		{name: "no sources", response: "See [1].", sources: 0},
+		{name: "not numbers", response: "See [a] and [1a] and [ 1 ].", sources: 3},
+		{name: "adjacent", response: "See [1][3].", sources: 3, cited: []int{0, 2}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if cited := parseCitations(test.response, test.sources); !reflect.DeepEqual(cited, test.cited) {
+				t.Errorf("parseCitations(%q, %d) = %v, want %v", test.response, test.sources, cited, test.cited)
+			}
+		})
+	}
+}
@@ -2,10 +2,15 @@ package s3
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"os"
+	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
@@ -33,6 +38,14 @@ func getClient() (*s3.S3, error) {
 	return s3.New(sess), nil
 }
 
+// BucketName names the bucket a commit of a repository is archived to. Bucket
+// names are limited to 63 lowercase letters, digits, dots and hyphens, which
+// repository URLs are not, so it is derived from a hash of both.
+func BucketName(repository string, commit string) string {
+	sum := sha256.Sum256([]byte(repository + "\x00" + commit))
+	return "archive-" + hex.EncodeToString(sum[:16])
+}
+
 type CreateBucketInput struct {
 	Bucket string
 }
@@ -43,6 +56,11 @@ func CreateBucket(input CreateBucketInput) error {
 		return fmt.Errorf("error getting S3 Client %w", err)
 	}
 	_, err = client.CreateBucket(&s3.CreateBucketInput{Bucket: aws.String(input.Bucket)})
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) && awsErr.Code() == s3.ErrCodeBucketAlreadyOwnedByYou {
+		// A retried attempt finds the bucket created by the previous one.
+		return nil
+	}
 	if err != nil {
 		return fmt.Errorf("error creating S3 Bucket %w", err)
 
@@ -54,12 +72,45 @@ type DeleteBucketInput struct {
 	Bucket string
 }
 
+// DeleteBucket deletes a bucket along with any objects still left in it.
 func DeleteBucket(input DeleteBucketInput) error {
 	client, err := getClient()
 	if err != nil {
 		return fmt.Errorf("error getting S3 Client %w", err)
 	}
 
+	var deleteErr error
+	err = client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(input.Bucket),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		if len(page.Contents) == 0 {
+			return true
+		}
+		objects := make([]*s3.ObjectIdentifier, len(page.Contents))
+		for i, object := range page.Contents {
+			objects[i] = &s3.ObjectIdentifier{Key: object.Key}
+		}
+		output, err := client.DeleteObjects(&s3.DeleteObjectsInput{
+			Bucket: aws.String(input.Bucket),
+			Delete: &s3.Delete{Objects: objects, Quiet: aws.Bool(true)},
+		})
+		if err == nil && len(output.Errors) > 0 {
+			err = fmt.Errorf("%d objects were not deleted, the first %s: %s", len(output.Errors), aws.StringValue(output.Errors[0].Key), aws.StringValue(output.Errors[0].Message))
+		}
+		deleteErr = err
+		return err == nil
+	})
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) && awsErr.Code() == s3.ErrCodeNoSuchBucket {
+		return nil
+	}
+	if err == nil {
+		err = deleteErr
+	}
+	if err != nil {
+		return fmt.Errorf("error emptying S3 Bucket %w", err)
+	}
+
 	_, err = client.DeleteBucket(&s3.DeleteBucketInput{
 		Bucket: aws.String(input.Bucket),
 	})
@@ -105,17 +156,38 @@ func GetObject(bucket string, key string) ([]byte, error) {
 	return body.Bytes(), err
 }
 
-type DeleteObjectInput struct {
-	Bucket string
-	Key    string
+// PutManifest stores a list of keys as a newline-separated object, so that
+// long lists of files never have to travel through workflow history.
+func PutManifest(bucket string, key string, keys []string) error {
+	return PutObject(bucket, key, []byte(strings.Join(keys, "\n")))
 }
 
-func DeleteObject(input DeleteObjectInput) (*s3.DeleteObjectOutput, error) {
-	s3Client, _ := getClient()
-	_, _ = s3Client.DeleteObject(&s3.DeleteObjectInput{
-		Bucket: aws.String(input.Bucket),
-		Key:    aws.String(input.Key),
-	})
+func GetManifest(bucket string, key string) ([]string, error) {
+	body, err := GetObject(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	if len(body) == 0 {
+		return []string{}, nil
+	}
+	return strings.Split(string(body), "\n"), nil
+}
+
+type GetManifestKeysInput struct {
+	Bucket   string
+	Manifest string
+	Offset   int
+	Limit    int
+}
 
-	return nil, nil
+// GetManifestKeys returns the keys at [Offset, Offset+Limit) of a manifest, so
+// that a shard reads the manifest once and hands each batch its own keys.
+func GetManifestKeys(input GetManifestKeysInput) ([]string, error) {
+	keys, err := GetManifest(input.Bucket, input.Manifest)
+	if err != nil {
+		return nil, fmt.Errorf("error reading manifest %s from bucket: %w", input.Manifest, err)
+	}
+	start := min(input.Offset, len(keys))
+	end := min(input.Offset+input.Limit, len(keys))
+	return keys[start:end], nil
 }
@@ -0,0 +1,155 @@
+package chunking
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+var (
+	MaxTokens     = 1000
+	OverlapTokens = 100
+)
+
+// Chunk is a piece of a file, identified by its 1-based, inclusive line range
+// and, for the pieces of a line too long to fit in one chunk, by the byte
+// offset at which Content starts within that line.
+type Chunk struct {
+	StartLine int
+	EndLine   int
+	Offset    int
+	Content   string
+}
+
+// EstimateTokens is a deliberately pessimistic token count: source code
+// tokenizes into more tokens per character than prose does.
+func EstimateTokens(text string) int {
+	return (len(text) + 2) / 3
+}
+
+// Split breaks a file into chunks of at most MaxTokens estimated tokens. Go
+// files are split along declarations; everything else, including Go files
+// that fail to parse, is split into overlapping line windows. Binary files
+// produce no chunks.
+func Split(path string, content []byte) []Chunk {
+	if len(bytes.TrimSpace(content)) == 0 || bytes.IndexByte(content, 0) >= 0 || !utf8.Valid(content) {
+		return nil
+	}
+
+	lines := splitLines(string(content))
+
+	var chunks []Chunk
+	if strings.ToLower(filepath.Ext(path)) == ".go" {
+		chunks = splitGo(content, lines)
+	}
+	if chunks == nil {
+		chunks = splitText(lines, 1, len(lines))
+	}
+
+	return chunks
+}
+
+func splitLines(content string) []string {
+	return strings.Split(strings.TrimSuffix(content, "\n"), "\n")
+}
+
+// splitText walks lines startLine through endLine, emitting a window each time
+// the next line would overflow MaxTokens. Consecutive windows share roughly
+// OverlapTokens worth of lines. Lines that are too long on their own are cut
+// into several chunks that all report the same line, at different offsets.
+// No two chunks share a start line and offset.
+func splitText(lines []string, startLine int, endLine int) []Chunk {
+	var chunks []Chunk
+
+	covered := startLine - 1
+	start := startLine
+	for start <= endLine {
+		tokens := 0
+		end := start
+		for end <= endLine {
+			lineTokens := EstimateTokens(lines[end-1]) + 1
+			if tokens > 0 && tokens+lineTokens > MaxTokens {
+				break
+			}
+			tokens += lineTokens
+			end++
+		}
+		end--
+
+		switch {
+		case tokens > MaxTokens:
+			chunks = append(chunks, splitLongLine(lines[start-1], start)...)
+		case end <= covered:
+			// Only the overlap fit before a line too long to join it, and
+			// the previous chunk already holds the overlap.
+			start = end + 1
+			continue
+		default:
+			chunk, ok := newChunk(lines, start, end)
+			if !ok {
+				break
+			}
+			// A window that starts on blank lines can trim down to the start
+			// of the previous chunk. The later window reaches further, so it
+			// takes the place of the earlier one.
+			if n := len(chunks); n > 0 && chunks[n-1].StartLine == chunk.StartLine && chunks[n-1].Offset == 0 {
+				chunks[n-1] = chunk
+			} else {
+				chunks = append(chunks, chunk)
+			}
+		}
+		covered = end
+		if end >= endLine {
+			break
+		}
+
+		next := end + 1
+		overlap := 0
+		for next-1 > start && overlap+EstimateTokens(lines[next-2])+1 <= OverlapTokens {
+			overlap += EstimateTokens(lines[next-2]) + 1
+			next--
+		}
+		start = next
+	}
+
+	return chunks
+}
+
+// newChunk builds the chunk for a line range, leaving out blank lines at
+// either end. It reports false when the range is entirely blank.
+func newChunk(lines []string, start int, end int) (Chunk, bool) {
+	for start <= end && strings.TrimSpace(lines[start-1]) == "" {
+		start++
+	}
+	for end >= start && strings.TrimSpace(lines[end-1]) == "" {
+		end--
+	}
+	if start > end {
+		return Chunk{}, false
+	}
+	return Chunk{
+		StartLine: start,
+		EndLine:   end,
+		Content:   strings.Join(lines[start-1:end], "\n"),
+	}, true
+}
+
+func splitLongLine(line string, lineNumber int) []Chunk {
+	var chunks []Chunk
+	size := MaxTokens * 3
+	for offset := 0; offset < len(line); {
+		n := min(size, len(line)-offset)
+		for offset+n < len(line) && !utf8.RuneStart(line[offset+n]) {
+			n--
+		}
+		chunks = append(chunks, Chunk{
+			StartLine: lineNumber,
+			EndLine:   lineNumber,
+			Offset:    offset,
+			Content:   line[offset : offset+n],
+		})
+		offset += n
+	}
+	return chunks
+}
@@ -0,0 +1,85 @@
+package chunking
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSplit(t *testing.T) {
+	long := strings.Repeat("x", MaxTokens*3*2+10)
+	wide := "a" + strings.Repeat("é", MaxTokens*3)
+	many := strings.Repeat(strings.Repeat("y", 2000)+"\n", 200)
+
+	tests := []struct {
+		name    string
+		path    string
+		content string
+		// chunks is the number of chunks expected, or -1 to only check
+		// that there are more than 64.
+		chunks    int
+		offsets   []int
+		lastLine  int
+		wholeLine string
+	}{
+		{name: "empty", path: "a.txt", content: "", chunks: 0},
+		{name: "blank", path: "a.txt", content: " \n\t\n", chunks: 0},
+		{name: "binary", path: "a.bin", content: "a\x00b", chunks: 0},
+		{name: "invalid utf-8", path: "a.txt", content: "a\xffb", chunks: 0},
+		{name: "short text", path: "a.txt", content: "one\ntwo\nthree\n", chunks: 1, offsets: []int{0}, lastLine: 3},
+		{name: "blank edges", path: "a.txt", content: "\n\none\n\n", chunks: 1, offsets: []int{0}, lastLine: 3},
+		{name: "go declarations", path: "a.go", content: "package a\n\nfunc A() {}\n\nfunc B() {}\n", chunks: 1, offsets: []int{0}, lastLine: 5},
+		{name: "long line", path: "a.min.js", content: long, chunks: 3, offsets: []int{0, 3000, 6000}, lastLine: 1, wholeLine: long},
+		{name: "lines before a long line", path: "a.txt", content: strings.Repeat("short\n", 10) + long, chunks: 4, offsets: []int{0, 0, 3000, 6000}, lastLine: 11},
+		{name: "blank line before a long line", path: "a.txt", content: "\none\ntwo\n" + long, chunks: 4, offsets: []int{0, 0, 3000, 6000}, lastLine: 4},
+		{name: "long multi-byte line", path: "a.txt", content: wide, chunks: 3, offsets: []int{0, 2999, 5999}, lastLine: 1, wholeLine: wide},
+		{name: "more than 64 chunks", path: "a.txt", content: many, chunks: -1, lastLine: 200},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			chunks := Split(test.path, []byte(test.content))
+			if test.chunks >= 0 && len(chunks) != test.chunks {
+				t.Fatalf("got %d chunks, want %d", len(chunks), test.chunks)
+			}
+			if test.chunks < 0 && len(chunks) <= 64 {
+				t.Fatalf("got %d chunks, want more than 64", len(chunks))
+			}
+			if len(chunks) == 0 {
+				return
+			}
+
+			if test.offsets != nil {
+				for i, chunk := range chunks {
+					if chunk.Offset != test.offsets[i] {
+						t.Errorf("chunk %d has offset %d, want %d", i, chunk.Offset, test.offsets[i])
+					}
+				}
+			}
+			if last := chunks[len(chunks)-1].EndLine; last != test.lastLine {
+				t.Errorf("last chunk ends on line %d, want %d", last, test.lastLine)
+			}
+
+			type key struct{ line, offset int }
+			seen := map[key]bool{}
+			var joined strings.Builder
+			for _, chunk := range chunks {
+				if k := (key{chunk.StartLine, chunk.Offset}); seen[k] {
+					t.Errorf("two chunks start at line %d offset %d", k.line, k.offset)
+				} else {
+					seen[k] = true
+				}
+				if !utf8.ValidString(chunk.Content) {
+					t.Errorf("chunk at line %d offset %d is not valid UTF-8", chunk.StartLine, chunk.Offset)
+				}
+				if EstimateTokens(chunk.Content) > MaxTokens {
+					t.Errorf("chunk at line %d offset %d has %d tokens", chunk.StartLine, chunk.Offset, EstimateTokens(chunk.Content))
+				}
+				joined.WriteString(chunk.Content)
+			}
+			if test.wholeLine != "" && joined.String() != test.wholeLine {
+				t.Errorf("the pieces of the line do not add up to it")
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package chunking
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"strings"
+)
+
+type span struct {
+	start int
+	end   int
+}
+
+// splitGo chunks a Go file along its top-level function and type
+// declarations, including their doc comments. Neighbouring small spans are
+// merged so that a file full of one-line helpers does not turn into dozens of
+// tiny chunks, and spans larger than MaxTokens fall back to line windows.
+func splitGo(content []byte, lines []string) []Chunk {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "", content, parser.ParseComments)
+	if err != nil {
+		return nil
+	}
+
+	var spans []span
+	covered := 0
+	addSpan := func(start int, end int) {
+		if start <= covered {
+			start = covered + 1
+		}
+		if end > len(lines) {
+			end = len(lines)
+		}
+		if start > end {
+			return
+		}
+		if start > covered+1 {
+			spans = append(spans, span{covered + 1, start - 1})
+		}
+		spans = append(spans, span{start, end})
+		covered = end
+	}
+
+	for _, decl := range file.Decls {
+		start := fset.Position(decl.Pos()).Line
+		switch d := decl.(type) {
+		case *ast.FuncDecl:
+			if d.Doc != nil {
+				start = fset.Position(d.Doc.Pos()).Line
+			}
+		case *ast.GenDecl:
+			if d.Doc != nil {
+				start = fset.Position(d.Doc.Pos()).Line
+			}
+		}
+		addSpan(start, fset.Position(decl.End()).Line)
+	}
+	if covered < len(lines) {
+		spans = append(spans, span{covered + 1, len(lines)})
+	}
+
+	var chunks []Chunk
+	var pending *span
+	pendingTokens := 0
+	flush := func() {
+		if pending == nil {
+			return
+		}
+		if chunk, ok := newChunk(lines, pending.start, pending.end); ok {
+			chunks = append(chunks, chunk)
+		}
+		pending = nil
+		pendingTokens = 0
+	}
+
+	for _, s := range spans {
+		tokens := EstimateTokens(strings.Join(lines[s.start-1:s.end], "\n"))
+		if tokens > MaxTokens {
+			flush()
+			chunks = append(chunks, splitText(lines, s.start, s.end)...)
+			continue
+		}
+		if pending != nil && pendingTokens+tokens > MaxTokens {
+			flush()
+		}
+		if pending == nil {
+			pending = &span{s.start, s.end}
+		} else {
+			pending.end = s.end
+		}
+		pendingTokens += tokens
+	}
+	flush()
+
+	return chunks
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"bitovi.com/code-analyzer/src/activities/llm"
+	"bitovi.com/code-analyzer/src/service"
+	"bitovi.com/code-analyzer/src/workflows"
+)
+
+func runIngest(args []string) {
+	ingest("ingest", args, false)
+}
+
+func runReindex(args []string) {
+	ingest("reindex", args, true)
+}
+
+func ingest(command string, args []string, reindex bool) {
+	o, args := parseFlags(command, args, 1, "ref", "format", "async", "watch")
+	c := connect()
+	defer c.Close()
+	ctx := context.Background()
+
+	run, err := service.StartIngestion(ctx, c, workflows.IngestRepositoryInput{
+		Repository: args[0],
+		Ref:        o.ref,
+		Reindex:    reindex,
+	})
+	if err != nil {
+		log.Fatalln("Unable to execute workflow", err)
+	}
+	if o.async {
+		printStarted(run.GetID())
+		return
+	}
+
+	var result workflows.IngestRepositoryOutput
+	if o.watch {
+		err = watchProgress(run, &result, func() string {
+			return describeIngestion(c, run.GetID())
+		})
+	} else {
+		err = run.Get(ctx, &result)
+	}
+	if err != nil {
+		log.Fatalln("Unable get workflow result", err)
+	}
+	printIngestion(o.format, result)
+}
+
+func runAsk(args []string) {
+	o, args := parseFlags("ask", args, 2, "ref", "model", "top-k", "mode", "filter", "format", "async", "watch", "stream")
+	c := connect()
+	defer c.Close()
+	ctx := context.Background()
+
+	input := workflows.AnalyzeInput{
+		Repository:    args[0],
+		Ref:           o.ref,
+		Query:         joinArgs(args[1:]),
+		RetrievalMode: o.mode,
+		TopK:          o.topK,
+		Filter:        o.filter,
+		Completion:    llm.CompletionOptions{Model: o.model},
+	}
+	run, err := service.StartAnalysis(ctx, c, input)
+	if err != nil {
+		log.Fatalln("Unable to execute workflow", err)
+	}
+	if o.async {
+		printStarted(run.GetID())
+		return
+	}
+
+	var result workflows.AnalyzeOutput
+	if o.stream {
+		printer := &answerPrinter{}
+		err = service.StreamAnswer(ctx, c, run.GetID(), func() error {
+			return run.Get(ctx, &result)
+		}, printer.update)
+		if err != nil {
+			log.Fatalln("Unable get workflow result", err)
+		}
+		printer.finish(result)
+		return
+	}
+
+	if o.watch {
+		err = watchProgress(run, &result, func() string {
+			return describeProgress(c, run.GetID())
+		})
+	} else {
+		err = run.Get(ctx, &result)
+	}
+	if err != nil {
+		log.Fatalln("Unable get workflow result", err)
+	}
+	printAnalysis(o.format, input.Query, result)
+}
+
+func runSearch(args []string) {
+	o, args := parseFlags("search", args, 2, "ref", "top-k", "mode", "filter", "format", "async")
+	c := connect()
+	defer c.Close()
+	ctx := context.Background()
+
+	input := workflows.SearchInput{
+		Repository:    args[0],
+		Ref:           o.ref,
+		Query:         joinArgs(args[1:]),
+		RetrievalMode: o.mode,
+		TopK:          o.topK,
+		Filter:        o.filter,
+	}
+	run, err := service.StartSearch(ctx, c, input)
+	if err != nil {
+		log.Fatalln("Unable to execute workflow", err)
+	}
+	if o.async {
+		printStarted(run.GetID())
+		return
+	}
+
+	var result workflows.SearchOutput
+	if err := run.Get(ctx, &result); err != nil {
+		log.Fatalln("Unable get workflow result", err)
+	}
+	printSearch(o.format, input.Query, result)
+}
+
+func runResult(args []string) {
+	o, args := parseFlags("result", args, 1, "format")
+	c := connect()
+	defer c.Close()
+
+	result, err := service.GetResult(context.Background(), c, args[0])
+	if err != nil {
+		log.Fatalln("Unable get workflow result", err)
+	}
+	switch {
+	case result.Analysis != nil:
+		printAnalysis(o.format, "", *result.Analysis)
+	case result.Search != nil:
+		printSearch(o.format, "", *result.Search)
+	case result.Ingestion != nil:
+		printIngestion(o.format, *result.Ingestion)
+	}
+}
+
+func runChat(args []string) {
+	o, args := parseFlags("chat", args, 1, "ref", "user", "model", "top-k", "mode", "filter", "format", "stream")
+	c := connect()
+	defer c.Close()
+	ctx := context.Background()
+	if o.user == "" {
+		log.Fatalln("A user is required, pass -user")
+	}
+
+	sessionID, err := service.StartChat(ctx, c, workflows.ChatSessionInput{
+		Repository:    args[0],
+		Ref:           o.ref,
+		User:          o.user,
+		RetrievalMode: o.mode,
+		TopK:          o.topK,
+		Filter:        o.filter,
+		Completion:    llm.CompletionOptions{Model: o.model},
+	})
+	if err != nil {
+		log.Fatalln("Unable to execute workflow", err)
+	}
+	fmt.Fprintf(os.Stderr, "Chatting in %s, one question per line, Ctrl-D to stop.\n", sessionID)
+
+	scanner := bufio.NewScanner(os.Stdin)
+	for {
+		fmt.Fprint(os.Stderr, "> ")
+		if !scanner.Scan() {
+			break
+		}
+		query := strings.TrimSpace(scanner.Text())
+		if query == "" {
+			continue
+		}
+
+		if o.stream {
+			printer := &answerPrinter{}
+			answer, err := service.AskStream(ctx, c, sessionID, query, printer.update)
+			if err != nil {
+				fmt.Println()
+				log.Println("Unable to answer question", err)
+				continue
+			}
+			printer.finish(workflows.AnalyzeOutput{
+				Response:  answer.Response,
+				Citations: answer.Citations,
+			})
+			continue
+		}
+
+		answer, err := service.Ask(ctx, c, sessionID, query)
+		if err != nil {
+			log.Println("Unable to answer question", err)
+			continue
+		}
+		printAnalysis(o.format, query, workflows.AnalyzeOutput{
+			Response:  answer.Response,
+			Citations: answer.Citations,
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		log.Fatalln("Unable to read question", err)
+	}
+}
+
+func runStatus(args []string) {
+	o, args := parseFlags("status", args, 1, "ref", "format")
+	c := connect()
+	defer c.Close()
+
+	status, err := service.GetRepositoryStatus(context.Background(), c, args[0], o.ref)
+	if err != nil {
+		log.Fatalln("Unable to get repository status", err)
+	}
+	printStatus(o.format, status)
+}
+
+func runList(args []string) {
+	o, args := parseFlags("list", args, 0, "format")
+	c := connect()
+	defer c.Close()
+	repository := ""
+	if len(args) > 0 {
+		repository = args[0]
+	}
+
+	repositories, err := service.ListRepositories(context.Background(), repository)
+	if err != nil {
+		log.Fatalln("Unable to list repositories", err)
+	}
+	printRepositories(o.format, repositories)
+}
+
+func runDelete(args []string) {
+	o, args := parseFlags("delete", args, 1, "ref")
+	c := connect()
+	defer c.Close()
+
+	deleted, err := service.DeleteRepository(context.Background(), c, args[0], o.ref)
+	if err != nil {
+		log.Fatalln("Unable to delete repository", err)
+	}
+	fmt.Printf("Deleted the index of %s, %d documents removed\n", args[0], deleted)
+}
@@ -1,52 +1,198 @@
 package main
 
 import (
-	"context"
+	"flag"
+	"fmt"
 	"log"
 	"os"
+	"strings"
 
+	"bitovi.com/code-analyzer/src/activities/db"
+	"bitovi.com/code-analyzer/src/activities/git"
+	"bitovi.com/code-analyzer/src/credentials"
 	"bitovi.com/code-analyzer/src/utils"
-	"bitovi.com/code-analyzer/src/workflows"
 	"github.com/joho/godotenv"
 	"go.temporal.io/sdk/client"
 )
 
+const usage = `Usage: go run ./src/client <command> [flags] <arguments>
+
+Commands:
+  ingest   [-ref] [-async] [-watch] <repository URL>
+           Bring the index of a ref up to date.
+  reindex  [-ref] [-async] [-watch] <repository URL>
+           Drop the index of a ref and ingest it again from scratch.
+  ask      [-ref] [-model] [-top-k] [-mode] [filters] [-format] [-async] [-watch] [-stream] <repository URL> <question>
+           Answer a question about a repository.
+  search   [-ref] [-top-k] [-mode] [filters] [-format] [-async] <repository URL> <query>
+           List the snippets most related to a query, without asking the LLM.
+  chat     [-ref] [-user] [-model] [-top-k] [-mode] [filters] [-format] [-stream] <repository URL>
+           Ask questions one line at a time, each answered with the conversation so far.
+  status   [-ref] [-format] <repository URL>
+           Show the indexed commit and the ingestion status of a ref.
+  list     [-format] [repository URL]
+           List the indexed refs, of every repository or of one.
+  delete   [-ref] <repository URL>
+           Drop the index and the refresh schedule of a ref.
+  result   [-format] <workflow ID>
+           Wait for a workflow started with -async and print its result.
+  schedule <create|list|pause|unpause|delete> ...
+           Manage the refresh schedules of refs.
+
+The filters -include, -exclude, -language and -dir restrict the snippets
+retrieved, and may each be repeated. Run a command with -h to see its flags.`
+
+type commandFunc func(args []string)
+
+var commands = map[string]commandFunc{
+	"ingest":   runIngest,
+	"reindex":  runReindex,
+	"ask":      runAsk,
+	"search":   runSearch,
+	"chat":     runChat,
+	"status":   runStatus,
+	"list":     runList,
+	"delete":   runDelete,
+	"result":   runResult,
+	"schedule": runSchedule,
+}
+
 func main() {
-	if len(os.Args) < 3 {
-		log.Fatalln("Usage: `go run src/client/main.go <repository URL> <query>`")
+	if len(os.Args) < 2 {
+		log.Fatalln(usage)
 	}
-	repository := os.Args[1]
-	query := os.Args[2]
+	command, ok := commands[os.Args[1]]
+	if !ok {
+		log.Fatalln(usage)
+	}
+	command(os.Args[2:])
+}
 
+func connect() client.Client {
 	err := godotenv.Load()
 	if err != nil {
 		log.Fatalln("Unable to load .env file", err)
 	}
+	// status and list read the repositories table directly.
+	db.DatabaseURL = os.Getenv("DATABASE_CONNECTION_STRING")
 
 	c, err := utils.GetTemporalClient()
 	if err != nil {
 		log.Fatalln("Unable to create client", err)
 	}
-	defer c.Close()
+	return c
+}
+
+// options holds the flags shared by the commands, each of which only
+// registers the ones it uses.
+type options struct {
+	ref    string
+	model  string
+	topK   int
+	mode   string
+	format string
+	user   string
+	async  bool
+	watch  bool
+	stream bool
+	filter db.DocumentFilter
+}
 
-	input := workflows.AnalyzeInput{
-		Repository: repository,
-		Query:      query,
+var optionFlags = map[string]func(flags *flag.FlagSet, o *options){
+	"ref": func(flags *flag.FlagSet, o *options) {
+		flags.StringVar(&o.ref, "ref", "", "branch, tag or commit SHA, the default branch if omitted")
+	},
+	"model": func(flags *flag.FlagSet, o *options) {
+		flags.StringVar(&o.model, "model", "", "completion model, the worker's COMPLETION_MODEL if omitted")
+	},
+	"top-k": func(flags *flag.FlagSet, o *options) {
+		flags.IntVar(&o.topK, "top-k", 0, "number of snippets to retrieve, 5 if omitted")
+	},
+	"mode": func(flags *flag.FlagSet, o *options) {
+		flags.StringVar(&o.mode, "mode", "", "retrieval mode: vector, lexical or hybrid (the default)")
+	},
+	"format": func(flags *flag.FlagSet, o *options) {
+		flags.StringVar(&o.format, "format", formatText, "output format: text, markdown or json")
+	},
+	"user": func(flags *flag.FlagSet, o *options) {
+		flags.StringVar(&o.user, "user", os.Getenv("USER"), "user the chat session belongs to")
+	},
+	"async": func(flags *flag.FlagSet, o *options) {
+		flags.BoolVar(&o.async, "async", false, "print the workflow ID and exit, fetch the result later with the result command")
+	},
+	"watch": func(flags *flag.FlagSet, o *options) {
+		flags.BoolVar(&o.watch, "watch", false, "show live ingestion progress while waiting")
+	},
+	// filter registers the flags of a db.DocumentFilter, which may be repeated.
+	"filter": func(flags *flag.FlagSet, o *options) {
+		flags.Func("include", "only retrieve files matching this `glob`, such as services/billing/** or *.go", appendTo(&o.filter.Include))
+		flags.Func("exclude", "never retrieve files matching this `glob`, such as **/*_test.go", appendTo(&o.filter.Exclude))
+		flags.Func("language", "only retrieve files in this `language`, such as go or typescript", appendTo(&o.filter.Languages))
+		flags.Func("dir", "only retrieve files below this `directory`", appendTo(&o.filter.Directories))
+	},
+	"stream": func(flags *flag.FlagSet, o *options) {
+		flags.BoolVar(&o.stream, "stream", false, "print the answer as it is generated, in the text format")
+	},
+}
+
+// parseFlags parses the named flags of a command and checks that at least
+// minArgs arguments follow them, the first of which, when present, is a
+// repository URL.
+func parseFlags(command string, args []string, minArgs int, names ...string) (options, []string) {
+	o := options{}
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	for _, name := range names {
+		optionFlags[name](flags, &o)
 	}
-	workflowID := "analyze-" + utils.CleanRepository(repository)
-	workflowOptions := client.StartWorkflowOptions{
-		ID:        workflowID,
-		TaskQueue: "ai-code-analyzer-queue",
+	flags.Parse(args)
+
+	if flags.NArg() < minArgs {
+		log.Fatalln(usage)
 	}
-	we, err := c.ExecuteWorkflow(context.Background(), workflowOptions, workflows.AnalyzeCode, input)
-	if err != nil {
-		log.Fatalln("Unable to execute workflow", err)
+	switch o.format {
+	case "", formatText, formatMarkdown, formatJSON:
+	default:
+		log.Fatalf("Unknown format %q, expected text, markdown or json", o.format)
 	}
+	if o.async && o.watch {
+		log.Fatalln("-async and -watch cannot be used together")
+	}
+	if o.stream && (o.async || o.watch || o.format != formatText) {
+		log.Fatalln("-stream prints text as it arrives and cannot be used with -async, -watch or -format")
+	}
+	if flags.NArg() > 0 && command != "result" {
+		validateTarget(flags.Arg(0), o.ref)
+	}
+	return o, flags.Args()
+}
 
-	var result workflows.AnalyzeOutput
-	err = we.Get(context.Background(), &result)
-	if err != nil {
-		log.Fatalln("Unable get workflow result", err)
+// validateTarget exits when a repository or ref would be rejected by the
+// worker, before any workflow starts.
+func validateTarget(repository string, ref string) {
+	if err := git.ValidateRepository(repository); err != nil {
+		log.Fatalln(err)
+	}
+	if credentials.HasEmbeddedSecret(repository) {
+		log.Fatalln("Repository URLs must not contain credentials, configure them on the worker instead")
+	}
+	if err := git.ValidateRef(ref); err != nil {
+		log.Fatalln(err)
 	}
-	log.Printf("Repository:\n%s\n\nQuestion:\n%s\n\nResponse:\n%s\n", repository, query, result.Response)
+}
+
+func appendTo(values *[]string) func(string) error {
+	return func(value string) error {
+		*values = append(*values, value)
+		return nil
+	}
+}
+
+// printStarted reports a workflow started with -async.
+func printStarted(workflowID string) {
+	fmt.Println(workflowID)
+	fmt.Fprintf(os.Stderr, "Started %s, fetch its result with `go run ./src/client result %s`\n", workflowID, workflowID)
+}
+
+func joinArgs(args []string) string {
+	return strings.Join(args, " ")
 }
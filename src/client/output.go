@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"bitovi.com/code-analyzer/src/activities/db"
+	"bitovi.com/code-analyzer/src/service"
+	"bitovi.com/code-analyzer/src/workflows"
+)
+
+const (
+	formatText     = "text"
+	formatMarkdown = "markdown"
+	formatJSON     = "json"
+)
+
+func printJSON(v interface{}) {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(v); err != nil {
+		log.Fatalln("Unable to encode result", err)
+	}
+}
+
+func printAnalysis(format string, query string, result workflows.AnalyzeOutput) {
+	switch format {
+	case formatJSON:
+		printJSON(result)
+	case formatMarkdown:
+		if query != "" {
+			fmt.Printf("## Question\n\n%s\n\n", query)
+		}
+		fmt.Printf("## Answer\n\n%s\n\n## Sources\n\n", result.Response)
+		for i, citation := range result.Citations {
+			cited := ""
+			if citation.Referenced {
+				cited = ", cited"
+			}
+			fmt.Printf("%d. `%s` lines %d-%d (score %.3f%s)\n", i+1, citation.Path, citation.StartLine, citation.EndLine, citation.Score, cited)
+		}
+		if result.FilesFailed > 0 {
+			fmt.Printf("\n## Files not indexed (%d)\n\n", result.FilesFailed)
+			for _, file := range result.FailedFiles {
+				fmt.Printf("- `%s`: %s\n", file.Key, file.Error)
+			}
+		}
+	default:
+		fmt.Printf("%s\n\n", result.Response)
+		printSources(result)
+	}
+}
+
+// printSources prints the text format of what follows the response of an
+// answer, which streamed answers print once the response is complete.
+func printSources(result workflows.AnalyzeOutput) {
+	fmt.Println("Sources:")
+	for i, citation := range result.Citations {
+		marker := " "
+		if citation.Referenced {
+			marker = "*"
+		}
+		fmt.Printf("%s[%d] %s:%d-%d (score %.3f)\n", marker, i+1, citation.Path, citation.StartLine, citation.EndLine, citation.Score)
+	}
+	if result.FilesFailed > 0 {
+		fmt.Printf("\n%d files could not be indexed:\n", result.FilesFailed)
+		for _, file := range result.FailedFiles {
+			fmt.Printf("%s: %s\n", file.Key, file.Error)
+		}
+	}
+}
+
+func printSearch(format string, query string, result workflows.SearchOutput) {
+	switch format {
+	case formatJSON:
+		printJSON(result)
+	case formatMarkdown:
+		if query != "" {
+			fmt.Printf("## Results for %q\n\n", query)
+		}
+		for i, r := range result.Results {
+			fmt.Printf("%d. `%s` lines %d-%d (score %.3f)\n\n```\n%s\n```\n\n", i+1, r.Path, r.StartLine, r.EndLine, r.Score, strings.TrimRight(r.Snippet, "\n"))
+		}
+	default:
+		for i, r := range result.Results {
+			if i > 0 {
+				fmt.Println()
+			}
+			fmt.Printf("[%d] %s:%d-%d (score %.3f)\n", i+1, r.Path, r.StartLine, r.EndLine, r.Score)
+			for n, line := range strings.Split(strings.TrimRight(r.Snippet, "\n"), "\n") {
+				fmt.Printf("%6d  %s\n", r.StartLine+n, line)
+			}
+		}
+	}
+}
+
+func printIngestion(format string, result workflows.IngestRepositoryOutput) {
+	if format == formatJSON {
+		printJSON(result)
+		return
+	}
+
+	summary := fmt.Sprintf("Indexed commit %s", result.Commit)
+	if result.UpToDate {
+		summary = fmt.Sprintf("Already up to date at commit %s", result.Commit)
+	}
+	if format == formatMarkdown {
+		fmt.Printf("**%s**\n\n", summary)
+		fmt.Printf("| Archived | Embedded | Skipped | Copied | Deleted | Failed | Rows inserted |\n|---|---|---|---|---|---|---|\n")
+		fmt.Printf("| %d | %d | %d | %d | %d | %d | %d |\n", result.FilesArchived, result.FilesEmbedded, result.FilesSkipped, result.FilesCopied, result.FilesDeleted, result.FilesFailed, result.RowsInserted)
+		return
+	}
+	fmt.Println(summary)
+	if !result.UpToDate {
+		fmt.Printf("archived %d, embedded %d, skipped %d, copied %d, deleted %d, failed %d, rows inserted %d (%.0f%% from cache)\n",
+			result.FilesArchived, result.FilesEmbedded, result.FilesSkipped, result.FilesCopied, result.FilesDeleted, result.FilesFailed, result.RowsInserted, result.CacheHitRate()*100)
+	}
+	for _, file := range result.FailedFiles {
+		fmt.Printf("%s: %s\n", file.Key, file.Error)
+	}
+}
+
+func printStatus(format string, status service.RepositoryStatus) {
+	if format == formatJSON {
+		printJSON(status)
+		return
+	}
+	if status.Status == "" {
+		fmt.Printf("%s %s has never been ingested\n", status.Repository.Repository, status.Ref)
+		return
+	}
+
+	fields := [][2]string{
+		{"Repository", status.Repository.Repository},
+		{"Ref", status.Ref},
+		{"Status", status.Status},
+		{"Phase", status.Phase},
+		{"Commit", status.Commit},
+		{"Pending commit", status.PendingCommit},
+		{"Embedding model", status.EmbeddingModel},
+		{"Files indexed", fmt.Sprint(status.FilesIndexed)},
+		{"Chunks indexed", fmt.Sprint(status.ChunksIndexed)},
+		{"Files failed", fmt.Sprint(status.FilesFailed)},
+		{"Started", formatTime(status.StartedAt)},
+		{"Finished", formatTime(status.FinishedAt)},
+		{"Last error", status.LastError},
+	}
+	if format == formatMarkdown {
+		fmt.Printf("| Field | Value |\n|---|---|\n")
+		for _, field := range fields {
+			fmt.Printf("| %s | %s |\n", field[0], field[1])
+		}
+	} else {
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		for _, field := range fields {
+			fmt.Fprintf(w, "%s:\t%s\n", field[0], field[1])
+		}
+		w.Flush()
+	}
+	if status.Ingestion != nil {
+		fmt.Printf("\nIngesting: %s | archived %d, shards %d/%d, embedded %d, failed %d\n",
+			status.Ingestion.Phase, status.Ingestion.FilesArchived, status.Ingestion.ShardsDone, status.Ingestion.Shards, status.Ingestion.FilesEmbedded, status.Ingestion.FilesFailed)
+	}
+}
+
+func printRepositories(format string, repositories []db.Repository) {
+	if format == formatJSON {
+		if repositories == nil {
+			repositories = []db.Repository{}
+		}
+		printJSON(repositories)
+		return
+	}
+
+	var w io.Writer
+	var row string
+	if format == formatMarkdown {
+		w = os.Stdout
+		row = "| %s | %s | %s | %s | %s | %s | %s |\n"
+		fmt.Fprintf(w, row, "Repository", "Ref", "Status", "Commit", "Files", "Chunks", "Updated")
+		fmt.Fprintln(w, "|---|---|---|---|---|---|---|")
+	} else {
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		defer tw.Flush()
+		w = tw
+		row = "%s\t%s\t%s\t%s\t%s\t%s\t%s\n"
+		fmt.Fprintf(w, row, "REPOSITORY", "REF", "STATUS", "COMMIT", "FILES", "CHUNKS", "UPDATED")
+	}
+	for _, r := range repositories {
+		commit := r.Commit
+		if len(commit) > 12 {
+			commit = commit[:12]
+		}
+		fmt.Fprintf(w, row, r.Repository, r.Ref, r.Status, commit, fmt.Sprint(r.FilesIndexed), fmt.Sprint(r.ChunksIndexed), formatTime(&r.UpdatedAt))
+	}
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.Local().Format(time.DateTime)
+}
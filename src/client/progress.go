@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"bitovi.com/code-analyzer/src/workflows"
+	"go.temporal.io/sdk/client"
+)
+
+// watchProgress redraws a single status line with describe every second until
+// the workflow completes.
+func watchProgress(run client.WorkflowRun, result interface{}, describe func() string) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- run.Get(context.Background(), result)
+	}()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	started := time.Now()
+	for {
+		select {
+		case err := <-done:
+			fmt.Fprint(os.Stderr, "\r\033[K")
+			return err
+		case <-ticker.C:
+			fmt.Fprintf(os.Stderr, "\r\033[K[%s] %s", time.Since(started).Round(time.Second), describe())
+		}
+	}
+}
+
+// describeProgress queries the progress of AnalyzeCode and, while it ingests,
+// that of its ingestion.
+func describeProgress(c client.Client, workflowID string) string {
+	response, err := c.QueryWorkflow(context.Background(), workflowID, "", workflows.ProgressQuery)
+	if err != nil {
+		return "waiting for the workflow to start"
+	}
+	var progress workflows.AnalyzeProgress
+	if err := response.Get(&progress); err != nil {
+		return err.Error()
+	}
+	if progress.Phase != workflows.PhaseIngesting && progress.Phase != workflows.PhaseWaiting {
+		return progress.Phase
+	}
+	return progress.Phase + ": " + describeIngestion(c, progress.IngestionWorkflowID)
+}
+
+func describeIngestion(c client.Client, workflowID string) string {
+	response, err := c.QueryWorkflow(context.Background(), workflowID, "", workflows.ProgressQuery)
+	if err != nil {
+		return "waiting for ingestion to start"
+	}
+	var ingestion workflows.IngestProgress
+	if err := response.Get(&ingestion); err != nil {
+		return err.Error()
+	}
+	return fmt.Sprintf(
+		"%s | archived %d, shards %d/%d, embedded %d, skipped %d, copied %d, deleted %d, failed %d, rows inserted %d (%.0f%% from cache)",
+		ingestion.Phase,
+		ingestion.FilesArchived,
+		ingestion.ShardsDone,
+		ingestion.Shards,
+		ingestion.FilesEmbedded,
+		ingestion.FilesSkipped,
+		ingestion.FilesCopied,
+		ingestion.FilesDeleted,
+		ingestion.FilesFailed,
+		ingestion.RowsInserted,
+		ingestion.CacheHitRate()*100,
+	)
+}
+
+// answerPrinter prints an answer as it is generated, given the text generated
+// so far each time it changes.
+type answerPrinter struct {
+	printed string
+}
+
+func (p *answerPrinter) update(text string) {
+	if !strings.HasPrefix(text, p.printed) {
+		// InvokePrompt was retried and generates the answer from the start.
+		fmt.Fprint(os.Stderr, "\n\n[The answer was interrupted, starting over]\n\n")
+		p.printed = ""
+	}
+	fmt.Print(text[len(p.printed):])
+	p.printed = text
+}
+
+// finish prints the rest of the final answer, then its sources.
+func (p *answerPrinter) finish(result workflows.AnalyzeOutput) {
+	p.update(result.Response)
+	fmt.Print("\n\n")
+	printSources(result)
+}
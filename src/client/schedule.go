@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+
+	"bitovi.com/code-analyzer/src/service"
+)
+
+const scheduleUsage = `Usage: go run ./src/client schedule <command> [flags] <arguments>
+
+Commands:
+  create [-ref] [-every] <repository URL>
+  list
+  pause|unpause|delete [-ref] <repository URL>`
+
+// runSchedule manages the refresh schedules of repositories.
+func runSchedule(args []string) {
+	if len(args) < 1 {
+		log.Fatalln(scheduleUsage)
+	}
+	ctx := context.Background()
+
+	switch args[0] {
+	case "create":
+		flags := flag.NewFlagSet("schedule create", flag.ExitOnError)
+		ref := flags.String("ref", "", "branch, tag or commit SHA, the default branch if omitted")
+		every := flags.String("every", service.DefaultRefreshCron, "cron expression or interval, such as 6h, between refreshes")
+		flags.Parse(args[1:])
+		repository := scheduleTarget(flags.Args(), *ref)
+		c := connect()
+		defer c.Close()
+
+		id, err := service.CreateRefreshSchedule(ctx, c, repository, *ref, *every)
+		if err != nil {
+			log.Fatalln("Unable to create schedule", err)
+		}
+		log.Printf("Created schedule %s (%s)", id, *every)
+	case "list":
+		c := connect()
+		defer c.Close()
+		schedules, err := service.ListRefreshSchedules(ctx, c)
+		if err != nil {
+			log.Fatalln("Unable to list schedules", err)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tREPOSITORY\tREF\tSCHEDULE\tPAUSED\tLAST RUN\tNEXT RUN")
+		for _, s := range schedules {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%t\t%s\t%s\n", s.ID, s.Repository, s.Ref, s.Spec, s.Paused, formatTime(s.LastRun), formatTime(s.NextRun))
+		}
+		w.Flush()
+	case "pause", "unpause", "delete":
+		flags := flag.NewFlagSet("schedule "+args[0], flag.ExitOnError)
+		ref := flags.String("ref", "", "branch, tag or commit SHA, the default branch if omitted")
+		flags.Parse(args[1:])
+		id := service.RefreshScheduleID(scheduleTarget(flags.Args(), *ref), *ref)
+		c := connect()
+		defer c.Close()
+
+		var err error
+		switch args[0] {
+		case "pause":
+			err = service.PauseRefreshSchedule(ctx, c, id, "Paused from the client")
+		case "unpause":
+			err = service.UnpauseRefreshSchedule(ctx, c, id, "Unpaused from the client")
+		case "delete":
+			err = service.DeleteRefreshSchedule(ctx, c, id)
+		}
+		if err != nil {
+			log.Fatalln("Unable to "+args[0]+" schedule", err)
+		}
+		log.Printf("Schedule %s: %sd", id, args[0])
+	default:
+		log.Fatalln(scheduleUsage)
+	}
+}
+
+func scheduleTarget(args []string, ref string) string {
+	if len(args) < 1 {
+		log.Fatalln(scheduleUsage)
+	}
+	validateTarget(args[0], ref)
+	return args[0]
+}
@@ -0,0 +1,175 @@
+package credentials
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+)
+
+var (
+	CredentialsFile = os.Getenv("GIT_CREDENTIALS_FILE")
+	CredentialsJSON = os.Getenv("GIT_CREDENTIALS")
+)
+
+// Host holds the credentials used for every repository on a single host.
+// Either Token (HTTPS) or one of SSHKey/SSHKeyFile (SSH deploy key) is set.
+type Host struct {
+	Username       string `json:"username"`
+	Token          string `json:"token"`
+	SSHKey         string `json:"sshKey"`
+	SSHKeyFile     string `json:"sshKeyFile"`
+	KnownHostsFile string `json:"knownHostsFile"`
+}
+
+var (
+	loadOnce sync.Once
+	hosts    map[string]Host
+	loadErr  error
+)
+
+func load() (map[string]Host, error) {
+	loadOnce.Do(func() {
+		hosts = map[string]Host{}
+
+		data := []byte(CredentialsJSON)
+		if CredentialsFile != "" {
+			data, loadErr = os.ReadFile(CredentialsFile)
+			if loadErr != nil {
+				loadErr = fmt.Errorf("error reading git credentials file: %w", loadErr)
+				return
+			}
+		}
+		if len(data) == 0 {
+			return
+		}
+
+		if err := json.Unmarshal(data, &hosts); err != nil {
+			loadErr = fmt.Errorf("error parsing git credentials: %w", err)
+		}
+	})
+	return hosts, loadErr
+}
+
+// ParseHost returns the host of an HTTPS, ssh:// or scp-like (git@host:path)
+// repository URL.
+func ParseHost(repository string) string {
+	if strings.Contains(repository, "://") {
+		u, err := url.Parse(repository)
+		if err != nil {
+			return ""
+		}
+		return u.Hostname()
+	}
+
+	host, _, found := strings.Cut(repository, ":")
+	if !found {
+		return ""
+	}
+	if i := strings.LastIndex(host, "@"); i >= 0 {
+		host = host[i+1:]
+	}
+	return host
+}
+
+// HasEmbeddedSecret reports whether an HTTP(S) repository URL carries user
+// info, which would end up in workflow history if it were used as an input.
+func HasEmbeddedSecret(repository string) bool {
+	u, err := url.Parse(repository)
+	if err != nil {
+		return false
+	}
+	return (u.Scheme == "http" || u.Scheme == "https") && u.User != nil
+}
+
+// GitEnv returns the environment that lets git authenticate against the host
+// of repository. Secrets are only ever passed through the environment of the
+// git process, never through its arguments. The returned cleanup function
+// must be called once git is done.
+func GitEnv(repository string) ([]string, func(), error) {
+	env := []string{"GIT_TERMINAL_PROMPT=0"}
+	cleanup := func() {}
+
+	configured, err := load()
+	if err != nil {
+		return nil, cleanup, err
+	}
+
+	host := ParseHost(repository)
+	creds, ok := configured[host]
+	if !ok {
+		return env, cleanup, nil
+	}
+
+	if creds.Token != "" {
+		username := creds.Username
+		if username == "" {
+			username = "x-access-token"
+		}
+		basic := base64.StdEncoding.EncodeToString([]byte(username + ":" + creds.Token))
+		env = append(env,
+			"GIT_CONFIG_COUNT=1",
+			fmt.Sprintf("GIT_CONFIG_KEY_0=http.https://%s/.extraHeader", host),
+			"GIT_CONFIG_VALUE_0=Authorization: Basic "+basic,
+		)
+	}
+
+	keyFile := creds.SSHKeyFile
+	if creds.SSHKey != "" {
+		file, err := os.CreateTemp("", "deploy-key-")
+		if err != nil {
+			return nil, cleanup, fmt.Errorf("error writing ssh key for %s: %w", host, err)
+		}
+		cleanup = func() { os.Remove(file.Name()) }
+
+		key := creds.SSHKey
+		if !strings.HasSuffix(key, "\n") {
+			key += "\n"
+		}
+		_, err = file.WriteString(key)
+		file.Close()
+		if err != nil {
+			cleanup()
+			return nil, func() {}, fmt.Errorf("error writing ssh key for %s: %w", host, err)
+		}
+		keyFile = file.Name()
+	}
+	if keyFile != "" {
+		ssh := fmt.Sprintf("ssh -i %s -o IdentitiesOnly=yes -o BatchMode=yes", keyFile)
+		if creds.KnownHostsFile != "" {
+			ssh += fmt.Sprintf(" -o UserKnownHostsFile=%s -o StrictHostKeyChecking=yes", creds.KnownHostsFile)
+		} else {
+			ssh += " -o StrictHostKeyChecking=accept-new"
+		}
+		env = append(env, "GIT_SSH_COMMAND="+ssh)
+	}
+
+	return env, cleanup, nil
+}
+
+// Redact strips URL user info and any configured token from text that is
+// about to be logged or returned as an error.
+func Redact(text string) string {
+	for _, field := range strings.Fields(text) {
+		field = strings.Trim(field, "'\",:;()")
+		u, err := url.Parse(field)
+		if err != nil || u.User == nil || u.Scheme == "" {
+			continue
+		}
+		if _, hasPassword := u.User.Password(); hasPassword || u.Scheme == "http" || u.Scheme == "https" {
+			u.User = nil
+			text = strings.ReplaceAll(text, field, u.String())
+		}
+	}
+
+	configured, _ := load()
+	for _, creds := range configured {
+		if creds.Token != "" {
+			text = strings.ReplaceAll(text, creds.Token, "[redacted]")
+		}
+	}
+	return text
+}
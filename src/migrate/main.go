@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+
+	"bitovi.com/code-analyzer/src/activities/db"
+	"github.com/joho/godotenv"
+)
+
+func main() {
+	if err := godotenv.Load(); err == nil {
+		db.DatabaseURL = os.Getenv("DATABASE_CONNECTION_STRING")
+	}
+
+	ctx := context.Background()
+	if len(os.Args) > 1 && os.Args[1] == "status" {
+		migrations, err := db.GetMigrations(ctx)
+		if err != nil {
+			log.Fatalln("Unable to list migrations", err)
+		}
+		for _, migration := range migrations {
+			status := "pending"
+			if migration.Applied {
+				status = "applied"
+			}
+			fmt.Printf("%-8s %s\n", status, migration.Name)
+		}
+		return
+	}
+
+	applied, err := db.Migrate(ctx)
+	for _, name := range applied {
+		fmt.Println("Applied", name)
+	}
+	if err != nil {
+		log.Fatalln("Unable to migrate database", err)
+	}
+	if len(applied) == 0 {
+		fmt.Println("Database is up to date")
+	}
+}
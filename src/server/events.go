@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"bitovi.com/code-analyzer/src/workflows"
+)
+
+// wantsEvents reports whether the caller asked for the answer to be streamed
+// as server-sent events rather than returned once complete.
+func wantsEvents(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+}
+
+type eventStream struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+}
+
+func newEventStream(w http.ResponseWriter) (*eventStream, bool) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return nil, false
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	return &eventStream{w: w, flusher: flusher}, true
+}
+
+func (s *eventStream) send(event string, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Println("Unable to encode event", err)
+		return
+	}
+	fmt.Fprintf(s.w, "event: %s\ndata: %s\n\n", event, data)
+	s.flusher.Flush()
+}
+
+// streamAnswer sends an answer as server-sent events while stream generates
+// it: delta events with the text appended to the answer, a reset event when
+// the answer starts over, then an answer event with the complete answer or an
+// error event. Once the events have started, errors can no longer change the
+// status of the response.
+func streamAnswer(w http.ResponseWriter, stream func(onText func(text string)) (workflows.AnalyzeOutput, error)) {
+	events, ok := newEventStream(w)
+	if !ok {
+		writeError(w, fmt.Errorf("the response cannot be streamed"))
+		return
+	}
+
+	sent := ""
+	onText := func(text string) {
+		if !strings.HasPrefix(text, sent) {
+			events.send("reset", struct{}{})
+			sent = ""
+		}
+		if text == sent {
+			return
+		}
+		events.send("delta", deltaEvent{Text: text[len(sent):]})
+		sent = text
+	}
+
+	output, err := stream(onText)
+	if err != nil {
+		events.send("error", newErrorResponse(errorStatus(err), err))
+		return
+	}
+	onText(output.Response)
+	events.send("answer", newAnswerResponse(output))
+}
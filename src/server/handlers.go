@@ -0,0 +1,540 @@
+package main
+
+import (
+	"crypto/subtle"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"bitovi.com/code-analyzer/src/activities/db"
+	"bitovi.com/code-analyzer/src/activities/git"
+	"bitovi.com/code-analyzer/src/activities/llm"
+	"bitovi.com/code-analyzer/src/credentials"
+	"bitovi.com/code-analyzer/src/service"
+	"bitovi.com/code-analyzer/src/utils"
+	"bitovi.com/code-analyzer/src/workflows"
+	"go.temporal.io/api/serviceerror"
+	"go.temporal.io/sdk/client"
+	"go.temporal.io/sdk/temporal"
+)
+
+//go:embed openapi.yaml
+var openAPISpec []byte
+
+const (
+	maxRequestBytes = 1 << 20
+	maxTopK         = 50
+	// maxFilters bounds each list of a filter, whose entries all become
+	// conditions of the retrieval queries.
+	maxFilters = 20
+)
+
+type server struct {
+	client client.Client
+	// token, when set, is the bearer token every /v1 request must carry. The
+	// API has no notion of users beyond that: whoever holds the token may act
+	// as any user.
+	token string
+}
+
+func (s *server) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/openapi.yaml", s.handleOpenAPI)
+	mux.HandleFunc("/health", s.handleHealth)
+	mux.HandleFunc("/v1/ingestions", s.handleIngestions)
+	mux.HandleFunc("/v1/questions", s.handleQuestions)
+	mux.HandleFunc("/v1/search", s.handleSearch)
+	mux.HandleFunc("/v1/workflows/", s.handleWorkflow)
+	mux.HandleFunc("/v1/repositories", s.handleRepositories)
+	mux.HandleFunc("/v1/repositories/status", s.handleRepositoryStatus)
+	mux.HandleFunc("/v1/chat/questions", s.handleChatQuestions)
+	mux.HandleFunc("/v1/chat/history", s.handleChatHistory)
+	return s.authenticate(mux)
+}
+
+// authenticate requires the bearer token on every /v1 request when one is
+// configured. The spec and health check stay open.
+func (s *server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.token != "" && strings.HasPrefix(r.URL.Path, "/v1/") {
+			token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				writeJSON(w, http.StatusUnauthorized, errorResponse{Error: "a valid bearer token is required"})
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *server) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/yaml")
+	w.Write(openAPISpec)
+}
+
+func (s *server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	if _, err := s.client.CheckHealth(r.Context(), &client.CheckHealthRequest{}); err != nil {
+		writeError(w, fmt.Errorf("temporal is unavailable: %w", err))
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// handleIngestions starts bringing the index of a ref up to date. The
+// ingestion runs in the background, its progress can be followed with
+// handleWorkflow.
+func (s *server) handleIngestions(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	var request ingestionRequest
+	if !decodeJSON(w, r, &request) {
+		return
+	}
+	if err := validateRepository(request.Repository, request.Ref); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	run, err := service.StartIngestion(r.Context(), s.client, workflows.IngestRepositoryInput{
+		Repository: request.Repository,
+		Ref:        request.Ref,
+		Reindex:    request.Reindex,
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, startedResponse{WorkflowID: run.GetID()})
+}
+
+// handleQuestions answers a question with AnalyzeCode, waiting for the answer
+// unless the request is async. Callers accepting text/event-stream receive the
+// answer as it is generated.
+func (s *server) handleQuestions(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	var request questionRequest
+	if !decodeJSON(w, r, &request) {
+		return
+	}
+	err := errors.Join(
+		validateRepository(request.Repository, request.Ref),
+		validateQuery(request.Query),
+		validateRetrieval(request.RetrievalMode, request.TopK),
+		validateFilter(request.filterRequest),
+	)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	run, err := service.StartAnalysis(r.Context(), s.client, workflows.AnalyzeInput{
+		Repository:    request.Repository,
+		Ref:           request.Ref,
+		Query:         request.Query,
+		RetrievalMode: request.RetrievalMode,
+		TopK:          request.TopK,
+		Filter:        request.filter(),
+		Completion:    llm.CompletionOptions{Model: request.Model},
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if request.Async {
+		writeJSON(w, http.StatusAccepted, startedResponse{WorkflowID: run.GetID()})
+		return
+	}
+	if wantsEvents(r) {
+		w.Header().Set("X-Workflow-Id", run.GetID())
+		s.streamAnalysis(w, r, run)
+		return
+	}
+
+	// The workflow carries on if the caller goes away, its answer can still
+	// be fetched with handleWorkflow.
+	var output workflows.AnalyzeOutput
+	if err := run.Get(r.Context(), &output); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newAnswerResponse(output))
+}
+
+// handleSearch finds the snippets most related to a query with SearchCode,
+// waiting for the results unless the request is async.
+func (s *server) handleSearch(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	var request searchRequest
+	if !decodeJSON(w, r, &request) {
+		return
+	}
+	err := errors.Join(
+		validateRepository(request.Repository, request.Ref),
+		validateQuery(request.Query),
+		validateRetrieval(request.RetrievalMode, request.TopK),
+		validateFilter(request.filterRequest),
+	)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	run, err := service.StartSearch(r.Context(), s.client, workflows.SearchInput{
+		Repository:    request.Repository,
+		Ref:           request.Ref,
+		Query:         request.Query,
+		RetrievalMode: request.RetrievalMode,
+		TopK:          request.TopK,
+		Filter:        request.filter(),
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if request.Async {
+		writeJSON(w, http.StatusAccepted, startedResponse{WorkflowID: run.GetID()})
+		return
+	}
+
+	var output workflows.SearchOutput
+	if err := run.Get(r.Context(), &output); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newSearchResponse(output))
+}
+
+// handleWorkflow reports the status of a workflow started by the API, with its
+// progress while it runs and its result once it has completed. The events of
+// an AnalyzeCode workflow stream its answer, like handleQuestions does.
+func (s *server) handleWorkflow(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	workflowID, events := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/v1/workflows/"), "/events")
+	if workflowID == "" || strings.Contains(workflowID, "/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	status, err := service.GetWorkflowStatus(r.Context(), s.client, workflowID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if !events {
+		writeJSON(w, http.StatusOK, newWorkflowResponse(status))
+		return
+	}
+	if status.WorkflowType != service.AnalyzeWorkflow {
+		writeError(w, validationError{"only the answers of " + service.AnalyzeWorkflow + " workflows can be streamed"})
+		return
+	}
+	s.streamAnalysis(w, r, s.client.GetWorkflow(r.Context(), workflowID, ""))
+}
+
+func (s *server) streamAnalysis(w http.ResponseWriter, r *http.Request, run client.WorkflowRun) {
+	streamAnswer(w, func(onText func(text string)) (workflows.AnalyzeOutput, error) {
+		var output workflows.AnalyzeOutput
+		err := service.StreamAnswer(r.Context(), s.client, run.GetID(), func() error {
+			return run.Get(r.Context(), &output)
+		}, onText)
+		return output, err
+	})
+}
+
+func (s *server) handleRepositories(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	repositories, err := service.ListRepositories(r.Context(), r.URL.Query().Get("repository"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	response := make([]repositoryResponse, len(repositories))
+	for i, repository := range repositories {
+		response[i] = newRepositoryResponse(repository)
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (s *server) handleRepositoryStatus(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	repository, ref := r.URL.Query().Get("repository"), r.URL.Query().Get("ref")
+	if err := validateRepository(repository, ref); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	status, err := service.GetRepositoryStatus(r.Context(), s.client, repository, ref)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if status.Status == "" {
+		writeJSON(w, http.StatusNotFound, errorResponse{Error: repository + " has never been ingested"})
+		return
+	}
+	response := newRepositoryResponse(status.Repository)
+	if status.Ingestion != nil {
+		response.Ingestion = newIngestionProgress(*status.Ingestion)
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// handleChatQuestions asks a question in the chat session of a user, starting
+// the session if needed, and waits for the answer, or streams it to callers
+// accepting text/event-stream.
+func (s *server) handleChatQuestions(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	var request chatRequest
+	if !decodeJSON(w, r, &request) {
+		return
+	}
+	err := errors.Join(
+		validateRepository(request.Repository, request.Ref),
+		validateUser(request.User),
+		validateQuery(request.Query),
+		validateRetrieval(request.RetrievalMode, request.TopK),
+		validateFilter(request.filterRequest),
+	)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	sessionID, err := service.StartChat(r.Context(), s.client, workflows.ChatSessionInput{
+		Repository:    request.Repository,
+		Ref:           request.Ref,
+		User:          request.User,
+		RetrievalMode: request.RetrievalMode,
+		TopK:          request.TopK,
+		Filter:        request.filter(),
+		Completion:    llm.CompletionOptions{Model: request.Model},
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if wantsEvents(r) {
+		streamAnswer(w, func(onText func(text string)) (workflows.AnalyzeOutput, error) {
+			answer, err := service.AskStream(r.Context(), s.client, sessionID, request.Query, onText)
+			return workflows.AnalyzeOutput{
+				Response:  answer.Response,
+				Citations: answer.Citations,
+			}, err
+		})
+		return
+	}
+
+	answer, err := service.Ask(r.Context(), s.client, sessionID, request.Query)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newAnswerResponse(workflows.AnalyzeOutput{
+		Response:  answer.Response,
+		Citations: answer.Citations,
+	}))
+}
+
+// handleChatHistory returns the conversation of any user, so it is only
+// served when the API is protected by a token.
+func (s *server) handleChatHistory(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	if s.token == "" {
+		writeJSON(w, http.StatusForbidden, errorResponse{Error: "chat histories are only served when SERVER_TOKEN is set"})
+		return
+	}
+	query := r.URL.Query()
+	err := errors.Join(
+		validateRepository(query.Get("repository"), query.Get("ref")),
+		validateUser(query.Get("user")),
+	)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	history, err := service.GetChatHistory(r.Context(), s.client, query.Get("repository"), query.Get("ref"), query.Get("user"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newChatHistoryResponse(history))
+}
+
+// Go 1.21's ServeMux does not match on methods, so each handler checks its
+// own.
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	writeJSON(w, http.StatusMethodNotAllowed, errorResponse{Error: "method " + r.Method + " is not allowed"})
+	return false
+}
+
+func decodeJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBytes))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: "invalid request body: " + err.Error()})
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println("Unable to write response", err)
+	}
+}
+
+// validationError is an invalid request, reported with a 400.
+type validationError struct {
+	message string
+}
+
+func (e validationError) Error() string {
+	return e.message
+}
+
+// validateRepository checks a repository and its ref before they reach git,
+// which the worker runs with them as arguments.
+func validateRepository(repository string, ref string) error {
+	if repository == "" {
+		return validationError{"repository is required"}
+	}
+	if err := git.ValidateRepository(repository); err != nil {
+		return validationError{err.Error()}
+	}
+	if credentials.HasEmbeddedSecret(repository) {
+		return validationError{"repository URLs must not contain credentials"}
+	}
+	if err := git.ValidateRef(ref); err != nil {
+		return validationError{err.Error()}
+	}
+	return nil
+}
+
+func validateQuery(query string) error {
+	if strings.TrimSpace(query) == "" {
+		return validationError{"query is required"}
+	}
+	return nil
+}
+
+func validateUser(user string) error {
+	if strings.TrimSpace(user) == "" {
+		return validationError{"user is required"}
+	}
+	return nil
+}
+
+func validateRetrieval(mode string, topK int) error {
+	switch mode {
+	case "", db.RetrievalVector, db.RetrievalLexical, db.RetrievalHybrid:
+	default:
+		return validationError{fmt.Sprintf("retrievalMode must be one of %s, %s or %s", db.RetrievalVector, db.RetrievalLexical, db.RetrievalHybrid)}
+	}
+	if topK < 0 || topK > maxTopK {
+		return validationError{fmt.Sprintf("topK must be between 1 and %d, or 0 for the default", maxTopK)}
+	}
+	return nil
+}
+
+func validateFilter(filter filterRequest) error {
+	lists := []struct {
+		name   string
+		values []string
+	}{
+		{"include", filter.Include},
+		{"exclude", filter.Exclude},
+		{"languages", filter.Languages},
+		{"directories", filter.Directories},
+	}
+	for _, list := range lists {
+		if len(list.values) > maxFilters {
+			return validationError{fmt.Sprintf("%s must not have more than %d entries", list.name, maxFilters)}
+		}
+		for _, value := range list.values {
+			if strings.TrimSpace(value) == "" {
+				return validationError{list.name + " must not have empty entries"}
+			}
+		}
+	}
+	return nil
+}
+
+// internalErrorMessage stands in for the text of the errors the server is at
+// fault for, which may reveal its internals. Those errors are logged instead.
+const internalErrorMessage = "internal server error"
+
+func writeError(w http.ResponseWriter, err error) {
+	status := errorStatus(err)
+	writeJSON(w, status, newErrorResponse(status, err))
+}
+
+// newErrorResponse describes an error answered with status, logging the
+// errors the server is at fault for rather than returning their text.
+func newErrorResponse(status int, err error) errorResponse {
+	if status == http.StatusInternalServerError {
+		log.Println("Request failed", err)
+		return errorResponse{Error: internalErrorMessage, Type: utils.ErrorType(err)}
+	}
+	return errorResponse{Error: err.Error(), Type: utils.ErrorType(err)}
+}
+
+// errorStatus maps errors to status codes: invalid requests and inputs the
+// workflows reject are the caller's fault, anything else is the server's.
+func errorStatus(err error) int {
+	var validation validationError
+	var notFound *serviceerror.NotFound
+	status := http.StatusInternalServerError
+	errType := utils.ErrorType(err)
+	switch {
+	case errors.As(err, &validation):
+		status = http.StatusBadRequest
+	case errors.As(err, &notFound):
+		status = http.StatusNotFound
+	case temporal.IsWorkflowExecutionAlreadyStartedError(err) || errors.Is(err, service.ErrChatOptionsDiffer):
+		status = http.StatusConflict
+	case errType == utils.ErrInvalidInput || errType == utils.ErrInvalidRepository || errType == utils.ErrInvalidRef:
+		status = http.StatusUnprocessableEntity
+	case errType == utils.ErrNotReady:
+		status = http.StatusConflict
+	case errType == utils.ErrRateLimited:
+		status = http.StatusTooManyRequests
+	case errType == utils.ErrBadCredentials || errType == utils.ErrUpstream:
+		status = http.StatusBadGateway
+	}
+	return status
+}
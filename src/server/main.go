@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"bitovi.com/code-analyzer/src/activities/db"
+	"bitovi.com/code-analyzer/src/utils"
+	"github.com/joho/godotenv"
+)
+
+const defaultAddress = ":8000"
+
+func main() {
+	// The .env file is optional, the server is usually configured through its
+	// environment.
+	if err := godotenv.Load(); err == nil {
+		db.DatabaseURL = os.Getenv("DATABASE_CONNECTION_STRING")
+	}
+
+	token := os.Getenv("SERVER_TOKEN")
+	if token == "" {
+		if os.Getenv("SERVER_INSECURE") != "true" {
+			log.Fatalln("SERVER_TOKEN is not set. Set it, or set SERVER_INSECURE=true to open the API to anyone who can reach it")
+		}
+		log.Println("SERVER_INSECURE is set, the API is open to anyone who can reach it and chat histories are not served")
+	}
+
+	c, err := utils.GetTemporalClient()
+	if err != nil {
+		log.Fatalln("Unable to create client", err)
+	}
+	defer c.Close()
+
+	address := os.Getenv("SERVER_ADDRESS")
+	if address == "" {
+		address = defaultAddress
+	}
+	s := &server{client: c, token: token}
+	httpServer := &http.Server{
+		Addr:              address,
+		Handler:           s.routes(),
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       time.Minute,
+		// Questions are answered synchronously unless they are async, which
+		// can take a few minutes when the repository is ingested first.
+		WriteTimeout: 15 * time.Minute,
+		IdleTimeout:  2 * time.Minute,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := httpServer.Shutdown(shutdownCtx); err != nil {
+			log.Println("Unable to shut down server", err)
+		}
+	}()
+
+	log.Println("Listening on", address)
+	if err := httpServer.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		log.Fatalln("Unable to start server", err)
+	}
+}
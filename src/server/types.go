@@ -0,0 +1,315 @@
+package main
+
+import (
+	"time"
+
+	"bitovi.com/code-analyzer/src/activities/db"
+	"bitovi.com/code-analyzer/src/service"
+	"bitovi.com/code-analyzer/src/workflows"
+)
+
+// The types below are the request and response bodies documented in
+// openapi.yaml. They keep the JSON of the API independent of the workflow
+// types, which may change along with the workflows.
+
+type ingestionRequest struct {
+	Repository string `json:"repository"`
+	Ref        string `json:"ref"`
+	Reindex    bool   `json:"reindex"`
+}
+
+// filterRequest holds the fields of a db.DocumentFilter, shared by the
+// requests that retrieve snippets.
+type filterRequest struct {
+	Include     []string `json:"include"`
+	Exclude     []string `json:"exclude"`
+	Languages   []string `json:"languages"`
+	Directories []string `json:"directories"`
+}
+
+type questionRequest struct {
+	Repository    string `json:"repository"`
+	Ref           string `json:"ref"`
+	Query         string `json:"query"`
+	RetrievalMode string `json:"retrievalMode"`
+	TopK          int    `json:"topK"`
+	filterRequest
+	Model string `json:"model"`
+	Async bool   `json:"async"`
+}
+
+type searchRequest struct {
+	Repository    string `json:"repository"`
+	Ref           string `json:"ref"`
+	Query         string `json:"query"`
+	RetrievalMode string `json:"retrievalMode"`
+	TopK          int    `json:"topK"`
+	filterRequest
+	Async bool `json:"async"`
+}
+
+type chatRequest struct {
+	Repository    string `json:"repository"`
+	Ref           string `json:"ref"`
+	User          string `json:"user"`
+	Query         string `json:"query"`
+	RetrievalMode string `json:"retrievalMode"`
+	TopK          int    `json:"topK"`
+	filterRequest
+	Model string `json:"model"`
+}
+
+type startedResponse struct {
+	WorkflowID string `json:"workflowId"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+	Type  string `json:"type,omitempty"`
+}
+
+type citation struct {
+	Path       string  `json:"path"`
+	StartLine  int     `json:"startLine"`
+	EndLine    int     `json:"endLine"`
+	Score      float64 `json:"score"`
+	Referenced bool    `json:"referenced"`
+}
+
+type failedFile struct {
+	Path  string `json:"path"`
+	Error string `json:"error"`
+}
+
+type answerResponse struct {
+	Response    string       `json:"response"`
+	Citations   []citation   `json:"citations"`
+	FilesFailed int          `json:"filesFailed"`
+	FailedFiles []failedFile `json:"failedFiles"`
+}
+
+type ingestionProgress struct {
+	Phase         string       `json:"phase"`
+	FilesArchived int          `json:"filesArchived"`
+	Shards        int          `json:"shards"`
+	ShardsDone    int          `json:"shardsDone"`
+	FilesEmbedded int          `json:"filesEmbedded"`
+	FilesSkipped  int          `json:"filesSkipped"`
+	FilesCopied   int          `json:"filesCopied"`
+	FilesDeleted  int          `json:"filesDeleted"`
+	FilesFailed   int          `json:"filesFailed"`
+	FailedFiles   []failedFile `json:"failedFiles"`
+	RowsInserted  int          `json:"rowsInserted"`
+	CacheHitRate  float64      `json:"cacheHitRate"`
+}
+
+type ingestionResponse struct {
+	Commit   string `json:"commit"`
+	UpToDate bool   `json:"upToDate"`
+	ingestionProgress
+}
+
+type searchResult struct {
+	Path      string  `json:"path"`
+	StartLine int     `json:"startLine"`
+	EndLine   int     `json:"endLine"`
+	Score     float64 `json:"score"`
+	Snippet   string  `json:"snippet"`
+}
+
+type searchResponse struct {
+	Commit  string         `json:"commit"`
+	Results []searchResult `json:"results"`
+}
+
+type progressResponse struct {
+	Phase           string             `json:"phase"`
+	Ingestion       *ingestionProgress `json:"ingestion,omitempty"`
+	PartialResponse string             `json:"partialResponse,omitempty"`
+}
+
+// deltaEvent is the data of the delta events of a streamed answer.
+type deltaEvent struct {
+	Text string `json:"text"`
+}
+
+type workflowResponse struct {
+	WorkflowID   string             `json:"workflowId"`
+	WorkflowType string             `json:"workflowType"`
+	Status       string             `json:"status"`
+	Progress     *progressResponse  `json:"progress,omitempty"`
+	Answer       *answerResponse    `json:"answer,omitempty"`
+	Search       *searchResponse    `json:"search,omitempty"`
+	Ingestion    *ingestionResponse `json:"ingestion,omitempty"`
+	Error        string             `json:"error,omitempty"`
+}
+
+type repositoryResponse struct {
+	Repository     string             `json:"repository"`
+	Ref            string             `json:"ref"`
+	Status         string             `json:"status"`
+	Phase          string             `json:"phase"`
+	Commit         string             `json:"commit,omitempty"`
+	PendingCommit  string             `json:"pendingCommit,omitempty"`
+	EmbeddingModel string             `json:"embeddingModel,omitempty"`
+	FilesIndexed   int                `json:"filesIndexed"`
+	ChunksIndexed  int                `json:"chunksIndexed"`
+	FilesFailed    int                `json:"filesFailed"`
+	LastError      string             `json:"lastError,omitempty"`
+	CreatedAt      *time.Time         `json:"createdAt,omitempty"`
+	UpdatedAt      *time.Time         `json:"updatedAt,omitempty"`
+	StartedAt      *time.Time         `json:"startedAt,omitempty"`
+	FinishedAt     *time.Time         `json:"finishedAt,omitempty"`
+	Ingestion      *ingestionProgress `json:"ingestion,omitempty"`
+}
+
+type chatMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type chatHistoryResponse struct {
+	Summary  string        `json:"summary"`
+	Messages []chatMessage `json:"messages"`
+}
+
+func (f filterRequest) filter() db.DocumentFilter {
+	return db.DocumentFilter{
+		Include:     f.Include,
+		Exclude:     f.Exclude,
+		Languages:   f.Languages,
+		Directories: f.Directories,
+	}
+}
+
+func newCitations(citations []workflows.Citation) []citation {
+	converted := make([]citation, len(citations))
+	for i, c := range citations {
+		converted[i] = citation{
+			Path:       c.Path,
+			StartLine:  c.StartLine,
+			EndLine:    c.EndLine,
+			Score:      c.Score,
+			Referenced: c.Referenced,
+		}
+	}
+	return converted
+}
+
+func newFailedFiles(files []db.FailedFile) []failedFile {
+	converted := make([]failedFile, len(files))
+	for i, f := range files {
+		converted[i] = failedFile{Path: f.Key, Error: f.Error}
+	}
+	return converted
+}
+
+func newAnswerResponse(output workflows.AnalyzeOutput) *answerResponse {
+	return &answerResponse{
+		Response:    output.Response,
+		Citations:   newCitations(output.Citations),
+		FilesFailed: output.FilesFailed,
+		FailedFiles: newFailedFiles(output.FailedFiles),
+	}
+}
+
+func newSearchResponse(output workflows.SearchOutput) *searchResponse {
+	results := make([]searchResult, len(output.Results))
+	for i, r := range output.Results {
+		results[i] = searchResult{
+			Path:      r.Path,
+			StartLine: r.StartLine,
+			EndLine:   r.EndLine,
+			Score:     r.Score,
+			Snippet:   r.Snippet,
+		}
+	}
+	return &searchResponse{
+		Commit:  output.Commit,
+		Results: results,
+	}
+}
+
+func newIngestionProgress(progress workflows.IngestProgress) *ingestionProgress {
+	return &ingestionProgress{
+		Phase:         progress.Phase,
+		FilesArchived: progress.FilesArchived,
+		Shards:        progress.Shards,
+		ShardsDone:    progress.ShardsDone,
+		FilesEmbedded: progress.FilesEmbedded,
+		FilesSkipped:  progress.FilesSkipped,
+		FilesCopied:   progress.FilesCopied,
+		FilesDeleted:  progress.FilesDeleted,
+		FilesFailed:   progress.FilesFailed,
+		FailedFiles:   newFailedFiles(progress.FailedFiles),
+		RowsInserted:  progress.RowsInserted,
+		CacheHitRate:  progress.CacheHitRate(),
+	}
+}
+
+func newWorkflowResponse(status service.WorkflowStatus) workflowResponse {
+	response := workflowResponse{
+		WorkflowID:   status.WorkflowID,
+		WorkflowType: status.WorkflowType,
+		Status:       status.Status,
+		Error:        status.Error,
+	}
+	if status.Progress != nil {
+		response.Progress = &progressResponse{
+			Phase:           status.Progress.Phase,
+			PartialResponse: status.Progress.PartialResponse,
+		}
+		if status.Progress.Ingestion != nil {
+			response.Progress.Ingestion = newIngestionProgress(*status.Progress.Ingestion)
+		}
+	}
+	if result := status.Result; result != nil {
+		switch {
+		case result.Analysis != nil:
+			response.Answer = newAnswerResponse(*result.Analysis)
+		case result.Search != nil:
+			response.Search = newSearchResponse(*result.Search)
+		case result.Ingestion != nil:
+			response.Ingestion = &ingestionResponse{
+				Commit:            result.Ingestion.Commit,
+				UpToDate:          result.Ingestion.UpToDate,
+				ingestionProgress: *newIngestionProgress(result.Ingestion.IngestProgress),
+			}
+		}
+	}
+	return response
+}
+
+func newRepositoryResponse(repository db.Repository) repositoryResponse {
+	response := repositoryResponse{
+		Repository:     repository.Repository,
+		Ref:            repository.Ref,
+		Status:         repository.Status,
+		Phase:          repository.Phase,
+		Commit:         repository.Commit,
+		PendingCommit:  repository.PendingCommit,
+		EmbeddingModel: repository.EmbeddingModel,
+		FilesIndexed:   repository.FilesIndexed,
+		ChunksIndexed:  repository.ChunksIndexed,
+		FilesFailed:    repository.FilesFailed,
+		LastError:      repository.LastError,
+		StartedAt:      repository.StartedAt,
+		FinishedAt:     repository.FinishedAt,
+	}
+	if !repository.CreatedAt.IsZero() {
+		response.CreatedAt = &repository.CreatedAt
+		response.UpdatedAt = &repository.UpdatedAt
+	}
+	return response
+}
+
+func newChatHistoryResponse(history workflows.ChatHistory) chatHistoryResponse {
+	messages := make([]chatMessage, len(history.History))
+	for i, m := range history.History {
+		messages[i] = chatMessage{Role: m.Role, Content: m.Content}
+	}
+	return chatHistoryResponse{
+		Summary:  history.Summary,
+		Messages: messages,
+	}
+}
@@ -0,0 +1,73 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"bitovi.com/code-analyzer/src/workflows"
+	"go.temporal.io/sdk/client"
+	"go.temporal.io/sdk/temporal"
+)
+
+// ErrChatOptionsDiffer is returned by StartChat when the session already
+// running answers with other options than the ones asked for.
+var ErrChatOptionsDiffer = errors.New("a chat session with other options is already running")
+
+// StartChat starts the chat session of a user about a ref, or returns the ID
+// of the session already running if it has the same options.
+func StartChat(ctx context.Context, c client.Client, input workflows.ChatSessionInput) (string, error) {
+	id := workflows.ChatWorkflowID(input.Repository, input.Ref, input.User)
+	run, err := c.ExecuteWorkflow(ctx, client.StartWorkflowOptions{
+		ID:                                       id,
+		TaskQueue:                                workflows.TaskQueue,
+		WorkflowExecutionErrorWhenAlreadyStarted: true,
+	}, workflows.ChatSession, input)
+	if err == nil {
+		return run.GetID(), nil
+	}
+	if !temporal.IsWorkflowExecutionAlreadyStartedError(err) {
+		return "", fmt.Errorf("error starting chat session: %w", err)
+	}
+
+	response, err := c.QueryWorkflow(ctx, id, "", workflows.OptionsQuery)
+	if err != nil {
+		return "", fmt.Errorf("error fetching chat session options: %w", err)
+	}
+	var options workflows.ChatOptions
+	if err := response.Get(&options); err != nil {
+		return "", fmt.Errorf("error fetching chat session options: %w", err)
+	}
+	if !options.Equal(input.Options()) {
+		return "", fmt.Errorf("%w: %s", ErrChatOptionsDiffer, id)
+	}
+	return id, nil
+}
+
+// Ask sends a question to a chat session and waits for its answer.
+func Ask(ctx context.Context, c client.Client, sessionID string, query string) (workflows.AnswerQueryOutput, error) {
+	handle, err := c.UpdateWorkflow(ctx, client.UpdateWorkflowOptions{
+		WorkflowID:   sessionID,
+		UpdateName:   workflows.AskUpdate,
+		Args:         []interface{}{workflows.ChatQuestion{Query: query}},
+		WaitForStage: client.WorkflowUpdateStageCompleted,
+	})
+	if err != nil {
+		return workflows.AnswerQueryOutput{}, fmt.Errorf("error asking question: %w", err)
+	}
+
+	var answer workflows.AnswerQueryOutput
+	err = handle.Get(ctx, &answer)
+	return answer, err
+}
+
+func GetChatHistory(ctx context.Context, c client.Client, repository string, ref string, user string) (workflows.ChatHistory, error) {
+	response, err := c.QueryWorkflow(ctx, workflows.ChatWorkflowID(repository, ref, user), "", workflows.HistoryQuery)
+	if err != nil {
+		return workflows.ChatHistory{}, fmt.Errorf("error fetching chat history: %w", err)
+	}
+
+	var history workflows.ChatHistory
+	err = response.Get(&history)
+	return history, err
+}
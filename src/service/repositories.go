@@ -0,0 +1,81 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"bitovi.com/code-analyzer/src/activities/db"
+	"bitovi.com/code-analyzer/src/activities/git"
+	"bitovi.com/code-analyzer/src/workflows"
+	"go.temporal.io/api/serviceerror"
+	"go.temporal.io/sdk/client"
+)
+
+// RepositoryStatus is the state of a ref as recorded in the repositories
+// table, with the live progress of its ingestion while one runs.
+type RepositoryStatus struct {
+	db.Repository
+	Ingestion *workflows.IngestProgress
+}
+
+// GetRepositoryStatus reads the repositories table directly, so the caller
+// needs DATABASE_CONNECTION_STRING as well as a Temporal client.
+func GetRepositoryStatus(ctx context.Context, c client.Client, repository string, ref string) (RepositoryStatus, error) {
+	if ref == "" {
+		ref = git.DefaultRef
+	}
+	stored, err := db.GetRepository(ctx, db.GetRepositoryInput{
+		Repository: repository,
+		Ref:        ref,
+	})
+	if err != nil {
+		return RepositoryStatus{}, err
+	}
+
+	status := RepositoryStatus{Repository: stored}
+	if stored.Status == db.StatusIngesting || stored.Status == db.StatusPending {
+		response, err := c.QueryWorkflow(ctx, workflows.IngestionWorkflowID(repository, ref), "", workflows.ProgressQuery)
+		if err == nil {
+			var progress workflows.IngestProgress
+			if err := response.Get(&progress); err == nil {
+				status.Ingestion = &progress
+			}
+		}
+	}
+	return status, nil
+}
+
+func ListRepositories(ctx context.Context, repository string) ([]db.Repository, error) {
+	return db.ListRepositories(ctx, db.ListRepositoriesInput{Repository: repository})
+}
+
+// DeleteRepository drops the index of a ref along with its refresh schedule.
+// It fails if the ref is being ingested. It returns the number of documents
+// deleted. The schedule is only deleted once the index is, so that a ref whose
+// deletion failed keeps being refreshed.
+func DeleteRepository(ctx context.Context, c client.Client, repository string, ref string) (int, error) {
+	run, err := c.ExecuteWorkflow(ctx, client.StartWorkflowOptions{
+		ID:                                       workflows.IngestionWorkflowID(repository, ref),
+		TaskQueue:                                workflows.TaskQueue,
+		WorkflowExecutionErrorWhenAlreadyStarted: true,
+	}, workflows.DeleteRepository, workflows.DeleteRepositoryInput{
+		Repository: repository,
+		Ref:        ref,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("error deleting %s, it may be being ingested: %w", repository, err)
+	}
+
+	var deleted int
+	if err := run.Get(ctx, &deleted); err != nil {
+		return 0, err
+	}
+
+	err = DeleteRefreshSchedule(ctx, c, RefreshScheduleID(repository, ref))
+	var notFound *serviceerror.NotFound
+	if err != nil && !errors.As(err, &notFound) {
+		return deleted, err
+	}
+	return deleted, nil
+}
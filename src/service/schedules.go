@@ -0,0 +1,171 @@
+// Package service holds the operations client programs perform against
+// Temporal on behalf of users, such as managing refresh schedules.
+package service
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"bitovi.com/code-analyzer/src/activities/git"
+	"bitovi.com/code-analyzer/src/utils"
+	"bitovi.com/code-analyzer/src/workflows"
+	"go.temporal.io/api/enums/v1"
+	"go.temporal.io/sdk/client"
+	"go.temporal.io/sdk/converter"
+)
+
+const (
+	refreshSchedulePrefix = "refresh-"
+
+	// DefaultRefreshCron refreshes every night at 03:00 UTC.
+	DefaultRefreshCron = "0 3 * * *"
+)
+
+// RefreshScheduleID is the ID of the refresh schedule of a ref. There is at
+// most one per ref.
+func RefreshScheduleID(repository string, ref string) string {
+	if ref == "" {
+		ref = git.DefaultRef
+	}
+	return utils.StableID(refreshSchedulePrefix, repository, ref)
+}
+
+type RefreshSchedule struct {
+	ID         string
+	Repository string
+	Ref        string
+	Spec       string
+	Paused     bool
+	Note       string
+	LastRun    *time.Time
+	NextRun    *time.Time
+}
+
+// CreateRefreshSchedule schedules RefreshRepository for a ref. spec is either
+// a cron expression, such as DefaultRefreshCron, or an interval such as "6h".
+// A run is skipped while the previous one is still going.
+func CreateRefreshSchedule(ctx context.Context, c client.Client, repository string, ref string, spec string) (string, error) {
+	if ref == "" {
+		ref = git.DefaultRef
+	}
+	scheduleSpec, err := parseScheduleSpec(spec)
+	if err != nil {
+		return "", err
+	}
+
+	id := RefreshScheduleID(repository, ref)
+	_, err = c.ScheduleClient().Create(ctx, client.ScheduleOptions{
+		ID:      id,
+		Spec:    scheduleSpec,
+		Overlap: enums.SCHEDULE_OVERLAP_POLICY_SKIP,
+		Action: &client.ScheduleWorkflowAction{
+			ID:        id,
+			Workflow:  workflows.RefreshRepository,
+			TaskQueue: workflows.TaskQueue,
+			Args: []interface{}{
+				workflows.IngestRepositoryInput{
+					Repository: repository,
+					Ref:        ref,
+				},
+			},
+		},
+		Memo: map[string]interface{}{
+			"Repository": repository,
+			"Ref":        ref,
+			"Spec":       spec,
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("error creating schedule %s: %w", id, err)
+	}
+	return id, nil
+}
+
+func parseScheduleSpec(spec string) (client.ScheduleSpec, error) {
+	if spec == "" {
+		spec = DefaultRefreshCron
+	}
+	if every, err := time.ParseDuration(spec); err == nil {
+		if every < time.Minute {
+			return client.ScheduleSpec{}, fmt.Errorf("refresh interval %s is shorter than a minute", every)
+		}
+		return client.ScheduleSpec{
+			Intervals: []client.ScheduleIntervalSpec{{Every: every}},
+		}, nil
+	}
+	if len(strings.Fields(spec)) != 5 && !strings.HasPrefix(spec, "@") {
+		return client.ScheduleSpec{}, fmt.Errorf("invalid schedule %q, expected a cron expression or a duration", spec)
+	}
+	return client.ScheduleSpec{
+		CronExpressions: []string{spec},
+	}, nil
+}
+
+func ListRefreshSchedules(ctx context.Context, c client.Client) ([]RefreshSchedule, error) {
+	iterator, err := c.ScheduleClient().List(ctx, client.ScheduleListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error listing schedules: %w", err)
+	}
+
+	var schedules []RefreshSchedule
+	for iterator.HasNext() {
+		entry, err := iterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("error listing schedules: %w", err)
+		}
+		if !strings.HasPrefix(entry.ID, refreshSchedulePrefix) {
+			continue
+		}
+
+		schedule := RefreshSchedule{
+			ID:     entry.ID,
+			Paused: entry.Paused,
+			Note:   entry.Note,
+		}
+		if entry.Memo != nil {
+			for name, field := range map[string]*string{
+				"Repository": &schedule.Repository,
+				"Ref":        &schedule.Ref,
+				"Spec":       &schedule.Spec,
+			} {
+				if payload, ok := entry.Memo.Fields[name]; ok {
+					_ = converter.GetDefaultDataConverter().FromPayload(payload, field)
+				}
+			}
+		}
+		if n := len(entry.RecentActions); n > 0 {
+			schedule.LastRun = &entry.RecentActions[n-1].ActualTime
+		}
+		if len(entry.NextActionTimes) > 0 {
+			schedule.NextRun = &entry.NextActionTimes[0]
+		}
+		schedules = append(schedules, schedule)
+	}
+	return schedules, nil
+}
+
+func PauseRefreshSchedule(ctx context.Context, c client.Client, id string, note string) error {
+	err := c.ScheduleClient().GetHandle(ctx, id).Pause(ctx, client.SchedulePauseOptions{Note: note})
+	if err != nil {
+		return fmt.Errorf("error pausing schedule %s: %w", id, err)
+	}
+	return nil
+}
+
+func UnpauseRefreshSchedule(ctx context.Context, c client.Client, id string, note string) error {
+	err := c.ScheduleClient().GetHandle(ctx, id).Unpause(ctx, client.ScheduleUnpauseOptions{Note: note})
+	if err != nil {
+		return fmt.Errorf("error unpausing schedule %s: %w", id, err)
+	}
+	return nil
+}
+
+func DeleteRefreshSchedule(ctx context.Context, c client.Client, id string) error {
+	err := c.ScheduleClient().GetHandle(ctx, id).Delete(ctx)
+	if err != nil {
+		return fmt.Errorf("error deleting schedule %s: %w", id, err)
+	}
+	return nil
+}
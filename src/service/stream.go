@@ -0,0 +1,101 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"bitovi.com/code-analyzer/src/activities/llm"
+	"bitovi.com/code-analyzer/src/workflows"
+	"go.temporal.io/api/serviceerror"
+	"go.temporal.io/sdk/client"
+	"go.temporal.io/sdk/converter"
+)
+
+const (
+	promptActivity = "InvokePrompt"
+	// streamInterval is how often StreamAnswer polls the answer. The worker
+	// heartbeats it at most every half second.
+	streamInterval = 250 * time.Millisecond
+)
+
+// PartialAnswer returns the answer generated so far by an AnalyzeCode workflow
+// or a chat session, read from the heartbeats of its InvokePrompt activity.
+// It is empty until the answer is being generated, and again once it has
+// been.
+func PartialAnswer(ctx context.Context, c client.Client, workflowID string) (string, error) {
+	description, err := c.DescribeWorkflowExecution(ctx, workflowID, "")
+	if err != nil {
+		return "", fmt.Errorf("error describing workflow %s: %w", workflowID, err)
+	}
+	if description.WorkflowExecutionInfo.Type.Name == AnalyzeWorkflow {
+		description, err = c.DescribeWorkflowExecution(ctx, workflows.AnswerWorkflowID(workflowID), "")
+		var notFound *serviceerror.NotFound
+		if errors.As(err, &notFound) {
+			return "", nil
+		}
+		if err != nil {
+			return "", fmt.Errorf("error describing workflow %s: %w", workflows.AnswerWorkflowID(workflowID), err)
+		}
+	}
+
+	for _, activity := range description.PendingActivities {
+		if activity.ActivityType.GetName() != promptActivity || activity.HeartbeatDetails == nil {
+			continue
+		}
+		var partial llm.PartialResponse
+		if err := converter.GetDefaultDataConverter().FromPayloads(activity.HeartbeatDetails, &partial); err != nil {
+			return "", fmt.Errorf("error decoding partial answer: %w", err)
+		}
+		return partial.Text, nil
+	}
+	return "", nil
+}
+
+// StreamAnswer calls onText with the answer generated so far by a workflow
+// whenever it changes, until wait returns. The text usually grows, but starts
+// over when InvokePrompt is retried. Failures to read the answer are ignored,
+// wait still returns the final one.
+func StreamAnswer(ctx context.Context, c client.Client, workflowID string, wait func() error, onText func(text string)) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- wait()
+	}()
+
+	ticker := time.NewTicker(streamInterval)
+	defer ticker.Stop()
+	last := ""
+	for {
+		select {
+		case err := <-done:
+			return err
+		case <-ticker.C:
+			text, err := PartialAnswer(ctx, c, workflowID)
+			if err != nil || text == "" || text == last {
+				continue
+			}
+			last = text
+			onText(text)
+		}
+	}
+}
+
+// AskStream is Ask calling onText with the answer as it is generated.
+func AskStream(ctx context.Context, c client.Client, sessionID string, query string, onText func(text string)) (workflows.AnswerQueryOutput, error) {
+	handle, err := c.UpdateWorkflow(ctx, client.UpdateWorkflowOptions{
+		WorkflowID:   sessionID,
+		UpdateName:   workflows.AskUpdate,
+		Args:         []interface{}{workflows.ChatQuestion{Query: query}},
+		WaitForStage: client.WorkflowUpdateStageAccepted,
+	})
+	if err != nil {
+		return workflows.AnswerQueryOutput{}, fmt.Errorf("error asking question: %w", err)
+	}
+
+	var answer workflows.AnswerQueryOutput
+	err = StreamAnswer(ctx, c, sessionID, func() error {
+		return handle.Get(ctx, &answer)
+	}, onText)
+	return answer, err
+}
@@ -0,0 +1,204 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"bitovi.com/code-analyzer/src/utils"
+	"bitovi.com/code-analyzer/src/workflows"
+	"github.com/google/uuid"
+	"go.temporal.io/api/enums/v1"
+	"go.temporal.io/sdk/client"
+)
+
+// Workflow types a Result can hold.
+const (
+	AnalyzeWorkflow = "AnalyzeCode"
+	SearchWorkflow  = "SearchCode"
+	IngestWorkflow  = "IngestRepository"
+)
+
+// workflowID gives every question its own workflow, so that several can be
+// asked about the same ref at once.
+func workflowID(prefix string, repository string, ref string) string {
+	id := prefix + "-" + utils.CleanRepository(repository)
+	if ref != "" {
+		id += "-" + utils.CleanRepository(ref)
+	}
+	return id + "-" + uuid.NewString()[:8]
+}
+
+func StartAnalysis(ctx context.Context, c client.Client, input workflows.AnalyzeInput) (client.WorkflowRun, error) {
+	run, err := c.ExecuteWorkflow(ctx, client.StartWorkflowOptions{
+		ID:        workflowID("analyze", input.Repository, input.Ref),
+		TaskQueue: workflows.TaskQueue,
+	}, workflows.AnalyzeCode, input)
+	if err != nil {
+		return nil, fmt.Errorf("error starting analysis: %w", err)
+	}
+	return run, nil
+}
+
+func StartSearch(ctx context.Context, c client.Client, input workflows.SearchInput) (client.WorkflowRun, error) {
+	run, err := c.ExecuteWorkflow(ctx, client.StartWorkflowOptions{
+		ID:        workflowID("search", input.Repository, input.Ref),
+		TaskQueue: workflows.TaskQueue,
+	}, workflows.SearchCode, input)
+	if err != nil {
+		return nil, fmt.Errorf("error starting search: %w", err)
+	}
+	return run, nil
+}
+
+// StartIngestion starts IngestRepository for a ref, or returns the ingestion
+// already running for it. A reindex is refused while the ref is being
+// ingested, since the running ingestion would not start over.
+func StartIngestion(ctx context.Context, c client.Client, input workflows.IngestRepositoryInput) (client.WorkflowRun, error) {
+	run, err := c.ExecuteWorkflow(ctx, client.StartWorkflowOptions{
+		ID:                                       workflows.IngestionWorkflowID(input.Repository, input.Ref),
+		TaskQueue:                                workflows.TaskQueue,
+		WorkflowExecutionErrorWhenAlreadyStarted: input.Reindex,
+	}, workflows.IngestRepository, input)
+	if err != nil {
+		return nil, fmt.Errorf("error starting ingestion: %w", err)
+	}
+	return run, nil
+}
+
+// Result is the outcome of a workflow started by StartAnalysis, StartSearch
+// or StartIngestion. Only the field matching WorkflowType is set.
+type Result struct {
+	WorkflowID   string
+	WorkflowType string
+	Analysis     *workflows.AnalyzeOutput
+	Search       *workflows.SearchOutput
+	Ingestion    *workflows.IngestRepositoryOutput
+}
+
+// GetResult waits for a workflow to complete and returns its result, so that
+// callers can start a workflow in one process and fetch its result in another.
+func GetResult(ctx context.Context, c client.Client, workflowID string) (Result, error) {
+	description, err := c.DescribeWorkflowExecution(ctx, workflowID, "")
+	if err != nil {
+		return Result{}, fmt.Errorf("error describing workflow %s: %w", workflowID, err)
+	}
+
+	result := Result{
+		WorkflowID:   workflowID,
+		WorkflowType: description.WorkflowExecutionInfo.Type.Name,
+	}
+	var value interface{}
+	switch result.WorkflowType {
+	case AnalyzeWorkflow:
+		result.Analysis = &workflows.AnalyzeOutput{}
+		value = result.Analysis
+	case SearchWorkflow:
+		result.Search = &workflows.SearchOutput{}
+		value = result.Search
+	case IngestWorkflow:
+		result.Ingestion = &workflows.IngestRepositoryOutput{}
+		value = result.Ingestion
+	default:
+		return Result{}, fmt.Errorf("workflow %s is a %s, which has no result to show", workflowID, result.WorkflowType)
+	}
+
+	if err := c.GetWorkflow(ctx, workflowID, "").Get(ctx, value); err != nil {
+		return Result{}, err
+	}
+	return result, nil
+}
+
+// Progress is the progress of a running AnalyzeCode or IngestRepository.
+// Ingestion holds the progress of the ref's ingestion while one runs, and
+// PartialResponse the answer generated so far while AnalyzeCode answers.
+type Progress struct {
+	Phase           string
+	Ingestion       *workflows.IngestProgress
+	PartialResponse string
+}
+
+// WorkflowStatus describes a workflow without waiting for it. Status is the
+// lower-cased Temporal execution status, such as running or completed.
+// Progress is set while the workflow runs, Result once it has completed and
+// Error if it failed.
+type WorkflowStatus struct {
+	WorkflowID   string
+	WorkflowType string
+	Status       string
+	Progress     *Progress
+	Result       *Result
+	Error        string
+}
+
+func GetWorkflowStatus(ctx context.Context, c client.Client, workflowID string) (WorkflowStatus, error) {
+	description, err := c.DescribeWorkflowExecution(ctx, workflowID, "")
+	if err != nil {
+		return WorkflowStatus{}, fmt.Errorf("error describing workflow %s: %w", workflowID, err)
+	}
+	info := description.WorkflowExecutionInfo
+
+	status := WorkflowStatus{
+		WorkflowID:   workflowID,
+		WorkflowType: info.Type.Name,
+		Status:       strings.ToLower(strings.TrimPrefix(enums.WorkflowExecutionStatus_name[int32(info.Status)], "WORKFLOW_EXECUTION_STATUS_")),
+	}
+	switch info.Status {
+	case enums.WORKFLOW_EXECUTION_STATUS_RUNNING:
+		status.Progress = getProgress(ctx, c, workflowID, status.WorkflowType)
+	case enums.WORKFLOW_EXECUTION_STATUS_COMPLETED:
+		if status.WorkflowType != AnalyzeWorkflow && status.WorkflowType != SearchWorkflow && status.WorkflowType != IngestWorkflow {
+			break
+		}
+		result, err := GetResult(ctx, c, workflowID)
+		if err != nil {
+			return WorkflowStatus{}, err
+		}
+		status.Result = &result
+	default:
+		if err := c.GetWorkflow(ctx, workflowID, "").Get(ctx, nil); err != nil {
+			status.Error = err.Error()
+		}
+	}
+	return status, nil
+}
+
+// getProgress returns nil when the workflow has no progress to report yet.
+func getProgress(ctx context.Context, c client.Client, workflowID string, workflowType string) *Progress {
+	ingestionID := workflowID
+	progress := Progress{}
+	if workflowType == AnalyzeWorkflow {
+		response, err := c.QueryWorkflow(ctx, workflowID, "", workflows.ProgressQuery)
+		if err != nil {
+			return nil
+		}
+		var analysis workflows.AnalyzeProgress
+		if err := response.Get(&analysis); err != nil {
+			return nil
+		}
+		progress.Phase = analysis.Phase
+		if analysis.Phase == workflows.PhaseAnswering {
+			progress.PartialResponse, _ = PartialAnswer(ctx, c, workflowID)
+		}
+		if analysis.Phase != workflows.PhaseIngesting && analysis.Phase != workflows.PhaseWaiting {
+			return &progress
+		}
+		ingestionID = analysis.IngestionWorkflowID
+	} else if workflowType != IngestWorkflow {
+		return nil
+	}
+
+	response, err := c.QueryWorkflow(ctx, ingestionID, "", workflows.ProgressQuery)
+	if err != nil {
+		return &progress
+	}
+	var ingestion workflows.IngestProgress
+	if err := response.Get(&ingestion); err != nil {
+		return &progress
+	}
+	if progress.Phase == "" {
+		progress.Phase = ingestion.Phase
+	}
+	progress.Ingestion = &ingestion
+	return &progress
+}
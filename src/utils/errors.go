@@ -0,0 +1,70 @@
+package utils
+
+import (
+	"errors"
+
+	"go.temporal.io/sdk/temporal"
+)
+
+// Types of the temporal.ApplicationErrors returned by activities and
+// workflows, so that callers can tell failures apart with errors.As.
+const (
+	ErrInvalidInput      = "InvalidInput"
+	ErrInvalidRepository = "InvalidRepository"
+	ErrInvalidRef        = "InvalidRef"
+	ErrBadCredentials    = "BadCredentials"
+	ErrConfiguration     = "InvalidConfiguration"
+	ErrNotReady          = "RepositoryNotReady"
+	ErrRateLimited       = "RateLimited"
+	ErrUpstream          = "UpstreamError"
+)
+
+// errorMessages are the messages of the application errors of each type. The
+// details are in the wrapped cause, which the error prints after its message.
+var errorMessages = map[string]string{
+	ErrInvalidInput:      "invalid input",
+	ErrInvalidRepository: "invalid repository",
+	ErrInvalidRef:        "invalid ref",
+	ErrBadCredentials:    "bad credentials",
+	ErrConfiguration:     "invalid configuration",
+	ErrNotReady:          "repository not ready",
+	ErrRateLimited:       "rate limited",
+	ErrUpstream:          "upstream error",
+}
+
+func errorMessage(errType string) string {
+	if message, ok := errorMessages[errType]; ok {
+		return message
+	}
+	return errType
+}
+
+// NonRetryableError marks err as permanent: retrying the activity cannot
+// succeed until something outside of it, such as configuration, changes.
+// Temporal only reads the type and retryability of the outermost error an
+// activity returns, so activities classify their errors right before
+// returning them rather than deep in the call stack.
+func NonRetryableError(errType string, err error) error {
+	return temporal.NewNonRetryableApplicationError(errorMessage(errType), errType, err)
+}
+
+// RetryableError tags err with a type while leaving it to the retry policy.
+func RetryableError(errType string, err error) error {
+	return temporal.NewApplicationErrorWithCause(errorMessage(errType), errType, err)
+}
+
+// IsNonRetryable reports whether err, or an error it wraps, is a
+// non-retryable application error.
+func IsNonRetryable(err error) bool {
+	var applicationErr *temporal.ApplicationError
+	return errors.As(err, &applicationErr) && applicationErr.NonRetryable()
+}
+
+// ErrorType returns the type of the application error wrapped by err, if any.
+func ErrorType(err error) string {
+	var applicationErr *temporal.ApplicationError
+	if errors.As(err, &applicationErr) {
+		return applicationErr.Type()
+	}
+	return ""
+}
@@ -0,0 +1,25 @@
+package utils
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestErrorMessage(t *testing.T) {
+	cause := errors.New("unknown revision main")
+	for _, err := range []error{
+		NonRetryableError(ErrInvalidRef, cause),
+		RetryableError(ErrInvalidRef, cause),
+	} {
+		if n := strings.Count(err.Error(), cause.Error()); n != 1 {
+			t.Errorf("%q holds the cause %d times, want once", err.Error(), n)
+		}
+		if !errors.Is(err, cause) {
+			t.Errorf("%q does not wrap its cause", err.Error())
+		}
+		if ErrorType(err) != ErrInvalidRef {
+			t.Errorf("%q has type %q, want %q", err.Error(), ErrorType(err), ErrInvalidRef)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package http
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
 	"fmt"
@@ -8,35 +9,77 @@ import (
 	"net/http"
 )
 
+// StatusError is returned by PostRequest when the server does not answer with
+// 200 OK.
+type StatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Body)
+}
+
 func PostRequest[T any](url string, body any, result T, apiKey string) (T, error) {
-	b, err := json.Marshal(body)
+	resp, err := post(url, body, apiKey)
 	if err != nil {
 		return result, err
 	}
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(b))
+	defer resp.Body.Close()
+
+	err = json.NewDecoder(resp.Body).Decode(&result)
 	if err != nil {
 		return result, err
 	}
 
-	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", apiKey))
-	req.Header.Add("Content-Type", "application/json")
+	return result, nil
+}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+// PostStream posts body and calls onLine with each line of the response as it
+// arrives, such as the events of a server-sent events stream. It stops at the
+// first error returned by onLine.
+func PostStream(url string, body any, apiKey string, onLine func(line string) error) error {
+	resp, err := post(url, body, apiKey)
 	if err != nil {
-		return result, err
+		return err
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return result, fmt.Errorf("%s", body)
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if err := onLine(scanner.Text()); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+func post(url string, body any, apiKey string) (*http.Response, error) {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewBuffer(b))
+	if err != nil {
+		return nil, err
 	}
 
-	err = json.NewDecoder(resp.Body).Decode(&result)
+	if apiKey != "" {
+		req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", apiKey))
+	}
+	req.Header.Add("Content-Type", "application/json")
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
 	if err != nil {
-		return result, err
+		return nil, err
 	}
 
-	return result, nil
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return nil, &StatusError{StatusCode: resp.StatusCode, Body: string(body)}
+	}
+	return resp, nil
 }
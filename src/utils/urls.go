@@ -1,6 +1,10 @@
 package utils
 
-import "strings"
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
 
 func CleanRepository(repository string) string {
 	replacer := strings.NewReplacer(
@@ -12,3 +16,18 @@ func CleanRepository(repository string) string {
 
 	return replacer.Replace(repository)
 }
+
+// StableID builds an ID, such as a workflow or schedule ID, from a prefix and
+// its parts. The cleaned up parts keep the ID readable, and a hash of their
+// exact values keeps parts that clean up alike, such as "alice.smith" and
+// "alice-smith", from sharing an ID.
+func StableID(prefix string, parts ...string) string {
+	hash := sha256.New()
+	cleaned := make([]string, len(parts))
+	for i, part := range parts {
+		hash.Write([]byte(part))
+		hash.Write([]byte{0})
+		cleaned[i] = CleanRepository(part)
+	}
+	return prefix + strings.Join(cleaned, "-") + "-" + hex.EncodeToString(hash.Sum(nil)[:8])
+}
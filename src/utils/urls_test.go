@@ -0,0 +1,29 @@
+package utils
+
+import "testing"
+
+func TestStableID(t *testing.T) {
+	id := StableID("chat-", "https://github.com/bitovi/example", "HEAD", "alice")
+	if id != StableID("chat-", "https://github.com/bitovi/example", "HEAD", "alice") {
+		t.Error("the same parts gave different IDs")
+	}
+
+	tests := []struct {
+		name string
+		a, b []string
+	}{
+		{"dots and dashes", []string{"https://github.com/bitovi/example", "HEAD", "alice.smith"}, []string{"https://github.com/bitovi/example", "HEAD", "alice-smith"}},
+		{"slashes and dashes", []string{"https://github.com/bitovi/example", "feature/x"}, []string{"https://github.com/bitovi/example", "feature-x"}},
+		{"scheme", []string{"https://github.com/bitovi/example", "HEAD"}, []string{"github.com/bitovi/example", "HEAD"}},
+		{"moved separator", []string{"https://github.com/bitovi/example-main", "x"}, []string{"https://github.com/bitovi/example", "main-x"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a, b := StableID("ingest-", test.a...), StableID("ingest-", test.b...)
+			if a == b {
+				t.Errorf("%q and %q share the ID %s", test.a, test.b, a)
+			}
+		})
+	}
+}
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"context"
 	"log"
+	"os"
+	"time"
 
 	"bitovi.com/code-analyzer/src/activities/db"
 	"bitovi.com/code-analyzer/src/activities/git"
@@ -13,28 +16,73 @@ import (
 )
 
 func main() {
+	if os.Getenv("DATABASE_MIGRATE_ON_START") != "false" {
+		applied, err := db.Migrate(context.Background())
+		if err != nil {
+			log.Fatalln("Unable to migrate database", err)
+		}
+		for _, name := range applied {
+			log.Println("Applied migration", name)
+		}
+	}
+
+	dimensions, err := llm.GetEmbeddingDimensions()
+	if err != nil {
+		log.Fatalln("Unable to configure embeddings", err)
+	}
+	if err := db.CheckEmbeddingDimensions(context.Background(), dimensions); err != nil {
+		log.Fatalln("Unable to use embeddings", err)
+	}
+
+	if os.Getenv("EMBEDDING_CACHE") != "false" {
+		llm.SetEmbeddingCache(db.EmbeddingCache{})
+	}
+
 	c, err := utils.GetTemporalClient()
 	if err != nil {
 		log.Fatalln("Unable to create client", err)
 	}
 	defer c.Close()
 
-	w := worker.New(c, "ai-code-analyzer-queue", worker.Options{})
+	w := worker.New(c, workflows.TaskQueue, worker.Options{
+		// Heartbeats are sent at most this often. InvokePrompt heartbeats the
+		// answer generated so far, so this bounds how smoothly it streams.
+		MaxHeartbeatThrottleInterval: 500 * time.Millisecond,
+	})
 
 	w.RegisterActivity(db.InsertEmbedding)
+	w.RegisterActivity(db.IndexFiles)
 	w.RegisterActivity(db.GetRelatedDocuments)
-	w.RegisterActivity(db.GetEmbeddingCount)
+	w.RegisterActivity(db.DeleteDocuments)
+	w.RegisterActivity(db.CopyDocuments)
+	w.RegisterActivity(db.DeleteUnreferencedDocuments)
+	w.RegisterActivity(db.IsCommitIndexed)
+	w.RegisterActivity(db.SetRepositoryCommit)
+	w.RegisterActivity(db.GetRepository)
+	w.RegisterActivity(db.ListRepositories)
+	w.RegisterActivity(db.UpdateRepositoryStatus)
+	w.RegisterActivity(db.DeleteRepository)
 
 	w.RegisterWorkflow(workflows.AnalyzeCode)
+	w.RegisterWorkflow(workflows.IngestRepository)
+	w.RegisterWorkflow(workflows.IngestShard)
+	w.RegisterWorkflow(workflows.RefreshRepository)
+	w.RegisterWorkflow(workflows.DeleteRepository)
+	w.RegisterWorkflow(workflows.SearchCode)
+	w.RegisterWorkflow(workflows.AnswerQuery)
+	w.RegisterWorkflow(workflows.ChatSession)
 
 	w.RegisterActivity(git.ArchiveRepository)
+	w.RegisterActivity(git.ResolveCommit)
 
-	w.RegisterActivity(llm.GetEmbeddingData)
+	w.RegisterActivity(llm.GetEmbeddingDataBatch)
+	w.RegisterActivity(llm.GetEmbeddingModel)
 	w.RegisterActivity(llm.InvokePrompt)
+	w.RegisterActivity(llm.SummarizeConversation)
 
 	w.RegisterActivity(s3.CreateBucket)
-	w.RegisterActivity(s3.DeleteObject)
 	w.RegisterActivity(s3.DeleteBucket)
+	w.RegisterActivity(s3.GetManifestKeys)
 
 	err = w.Run(worker.InterruptCh())
 	if err != nil {
@@ -0,0 +1,122 @@
+package workflows
+
+import (
+	"time"
+
+	"bitovi.com/code-analyzer/src/activities/db"
+	"bitovi.com/code-analyzer/src/activities/llm"
+	"go.temporal.io/sdk/workflow"
+)
+
+// defaultTopK is the number of snippets retrieved when the caller does not say.
+const defaultTopK = 5
+
+// promptActivityOptions lets InvokePrompt generate long answers. It heartbeats
+// the response generated so far, which clients read to stream the answer.
+var promptActivityOptions = workflow.ActivityOptions{
+	StartToCloseTimeout: 2 * time.Minute,
+	HeartbeatTimeout:    10 * time.Second,
+	RetryPolicy:         &llmRetryPolicy,
+}
+
+// AnswerWorkflowID is the ID of the AnswerQuery child of an AnalyzeCode
+// workflow.
+func AnswerWorkflowID(workflowID string) string {
+	return workflowID + "-answer"
+}
+
+type AnswerQueryInput struct {
+	Repository    string
+	Commit        string
+	Query         string
+	RetrievalMode string
+	TopK          int
+	Filter        db.DocumentFilter
+	Completion    llm.CompletionOptions
+	// Summary and History give the context of an ongoing conversation.
+	Summary string
+	History []llm.ChatMessage
+}
+type AnswerQueryOutput struct {
+	Response  string
+	Citations []Citation
+}
+
+// Citation is one of the snippets an answer was based on. Referenced is set
+// when the answer explicitly cites it. Score is the snippet's retrieval score,
+// whose meaning depends on the retrieval mode (see db.EmbeddingRecord).
+type Citation struct {
+	Path       string
+	StartLine  int
+	EndLine    int
+	Score      float64
+	Referenced bool
+}
+
+func AnswerQuery(ctx workflow.Context, input AnswerQueryInput) (AnswerQueryOutput, error) {
+	var relatedDocuments db.GetRelatedDocumentsOutput
+	err := workflow.ExecuteActivity(
+		workflow.WithRetryPolicy(workflow.WithActivityOptions(ctx, defaultActivityOptions), llmRetryPolicy),
+		db.GetRelatedDocuments,
+		db.GetRelatedDocumentsInput{
+			Repository: input.Repository,
+			Commit:     input.Commit,
+			Query:      input.Query,
+			Limit:      topK(input.TopK),
+			Mode:       input.RetrievalMode,
+			Filter:     input.Filter,
+		},
+	).Get(ctx, &relatedDocuments)
+	if err != nil {
+		return AnswerQueryOutput{}, err
+	}
+
+	sources := make([]llm.Source, len(relatedDocuments.Records))
+	citations := make([]Citation, len(relatedDocuments.Records))
+	for i, record := range relatedDocuments.Records {
+		sources[i] = llm.Source{
+			Key:       record.Key,
+			StartLine: record.StartLine,
+			EndLine:   record.EndLine,
+			Content:   record.Content,
+		}
+		citations[i] = Citation{
+			Path:      record.Key,
+			StartLine: record.StartLine,
+			EndLine:   record.EndLine,
+			Score:     record.Score,
+		}
+	}
+
+	var result llm.InvokePromptOutput
+	err = workflow.ExecuteActivity(
+		workflow.WithActivityOptions(ctx, promptActivityOptions),
+		llm.InvokePrompt,
+		llm.InvokePromptInput{
+			Query:      input.Query,
+			Sources:    sources,
+			Summary:    input.Summary,
+			History:    input.History,
+			Completion: input.Completion,
+		},
+	).Get(ctx, &result)
+	if err != nil {
+		return AnswerQueryOutput{}, err
+	}
+
+	for _, i := range result.Cited {
+		citations[i].Referenced = true
+	}
+
+	return AnswerQueryOutput{
+		Response:  result.Response,
+		Citations: citations,
+	}, nil
+}
+
+func topK(k int) int {
+	if k <= 0 {
+		return defaultTopK
+	}
+	return k
+}
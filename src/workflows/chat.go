@@ -0,0 +1,219 @@
+package workflows
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"bitovi.com/code-analyzer/src/activities/db"
+	"bitovi.com/code-analyzer/src/activities/git"
+	"bitovi.com/code-analyzer/src/activities/llm"
+	"bitovi.com/code-analyzer/src/utils"
+	"go.temporal.io/sdk/workflow"
+)
+
+const (
+	AskUpdate    = "ask"
+	HistoryQuery = "history"
+	OptionsQuery = "options"
+
+	// chatHistoryTokens bounds the recent messages sent with each question;
+	// older messages are folded into the summary.
+	chatHistoryTokens = 3000
+	// chatTurnsPerRun keeps the history of a single run small; the session
+	// continues as new once it is reached.
+	chatTurnsPerRun = 50
+	chatIdleTimeout = 24 * time.Hour
+)
+
+type ChatSessionInput struct {
+	Repository    string
+	Ref           string
+	User          string
+	RetrievalMode string
+	TopK          int
+	Filter        db.DocumentFilter
+	Completion    llm.CompletionOptions
+
+	// Summary and History are carried over from the previous run when the
+	// session continues as new.
+	Summary string
+	History []llm.ChatMessage
+}
+
+// ChatOptions are the settings a session answers all of its questions with.
+type ChatOptions struct {
+	RetrievalMode string
+	TopK          int
+	Filter        db.DocumentFilter
+	Completion    llm.CompletionOptions
+}
+
+// Equal reports whether sessions started with either options would answer
+// alike.
+func (o ChatOptions) Equal(other ChatOptions) bool {
+	a, b := o.Completion, other.Completion
+	sameTemperature := a.Temperature == nil && b.Temperature == nil ||
+		a.Temperature != nil && b.Temperature != nil && *a.Temperature == *b.Temperature
+	return o.RetrievalMode == other.RetrievalMode &&
+		o.TopK == other.TopK &&
+		o.Filter.Equal(other.Filter) &&
+		a.Model == b.Model && a.BaseURL == b.BaseURL && a.MaxTokens == b.MaxTokens && sameTemperature
+}
+
+func (i ChatSessionInput) Options() ChatOptions {
+	return ChatOptions{
+		RetrievalMode: i.RetrievalMode,
+		TopK:          i.TopK,
+		Filter:        i.Filter,
+		Completion:    i.Completion,
+	}
+}
+
+type ChatQuestion struct {
+	Query string
+}
+
+type ChatHistory struct {
+	Summary string
+	History []llm.ChatMessage
+}
+
+// ChatWorkflowID is the ID of the ChatSession of a user about a ref.
+func ChatWorkflowID(repository string, ref string, user string) string {
+	if ref == "" {
+		ref = git.DefaultRef
+	}
+	return utils.StableID("chat-", repository, ref, user)
+}
+
+// ChatSession is a long-running conversation about a repository. Questions
+// arrive through the AskUpdate update and are answered one at a time, with the
+// conversation so far included in the prompt. Each question is answered at the
+// ref's current commit, so a session outlives refreshes of its ref. The
+// session ends after a day without questions.
+func ChatSession(ctx workflow.Context, input ChatSessionInput) error {
+	state := input
+	turns := 0
+	mutex := workflow.NewMutex(ctx)
+
+	err := workflow.SetQueryHandler(ctx, HistoryQuery, func() (ChatHistory, error) {
+		return ChatHistory{
+			Summary: state.Summary,
+			History: state.History,
+		}, nil
+	})
+	if err != nil {
+		return err
+	}
+	err = workflow.SetQueryHandler(ctx, OptionsQuery, func() (ChatOptions, error) {
+		return state.Options(), nil
+	})
+	if err != nil {
+		return err
+	}
+
+	ask := func(ctx workflow.Context, question ChatQuestion) (AnswerQueryOutput, error) {
+		if err := mutex.Lock(ctx); err != nil {
+			return AnswerQueryOutput{}, err
+		}
+		defer mutex.Unlock()
+		turns++
+
+		answerAtCurrentCommit := func() (AnswerQueryOutput, error) {
+			ingestion, err := ingestRef(ctx, IngestRepositoryInput{
+				Repository: state.Repository,
+				Ref:        state.Ref,
+			}, nil)
+			if err != nil {
+				return AnswerQueryOutput{}, err
+			}
+
+			return AnswerQuery(ctx, AnswerQueryInput{
+				Repository:    state.Repository,
+				Commit:        ingestion.Commit,
+				Query:         question.Query,
+				RetrievalMode: state.RetrievalMode,
+				TopK:          state.TopK,
+				Filter:        state.Filter,
+				Completion:    state.Completion,
+				Summary:       state.Summary,
+				History:       state.History,
+			})
+		}
+
+		answer, err := answerAtCurrentCommit()
+		if utils.ErrorType(err) == utils.ErrNotReady {
+			// A refresh replaced the commit between its ingestion and the
+			// retrieval, and deleted its documents.
+			answer, err = answerAtCurrentCommit()
+		}
+		if err != nil {
+			return AnswerQueryOutput{}, err
+		}
+
+		state.History = append(state.History,
+			llm.ChatMessage{Role: "user", Content: question.Query},
+			llm.ChatMessage{Role: "assistant", Content: answer.Response},
+		)
+		older, recent := llm.SplitHistory(state.History, chatHistoryTokens)
+		if len(older) > 0 {
+			var summary string
+			err := workflow.ExecuteActivity(
+				workflow.WithActivityOptions(ctx, defaultActivityOptions),
+				llm.SummarizeConversation,
+				llm.SummarizeConversationInput{
+					Summary:    state.Summary,
+					Messages:   older,
+					Completion: state.Completion,
+				},
+			).Get(ctx, &summary)
+			if err != nil {
+				workflow.GetLogger(ctx).Warn("Unable to summarise conversation, dropping older messages", "Error", err)
+			} else {
+				state.Summary = summary
+			}
+			state.History = recent
+		}
+
+		return answer, nil
+	}
+
+	err = workflow.SetUpdateHandlerWithOptions(ctx, AskUpdate, ask, workflow.UpdateHandlerOptions{
+		Validator: func(ctx workflow.Context, question ChatQuestion) error {
+			if strings.TrimSpace(question.Query) == "" {
+				return errors.New("query must not be empty")
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	continueAsNew := func() bool {
+		return turns >= chatTurnsPerRun || workflow.GetInfo(ctx).GetContinueAsNewSuggested()
+	}
+	for {
+		seen := turns
+		asked, err := workflow.AwaitWithTimeout(ctx, chatIdleTimeout, func() bool {
+			return turns != seen || continueAsNew()
+		})
+		if err != nil {
+			return err
+		}
+
+		if !asked || continueAsNew() {
+			err := workflow.Await(ctx, func() bool {
+				return workflow.AllHandlersFinished(ctx)
+			})
+			if err != nil {
+				return err
+			}
+			if !asked {
+				return nil
+			}
+			return workflow.NewContinueAsNewError(ctx, ChatSession, state)
+		}
+	}
+}
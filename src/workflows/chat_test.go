@@ -0,0 +1,136 @@
+package workflows
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"bitovi.com/code-analyzer/src/activities/db"
+	"bitovi.com/code-analyzer/src/activities/llm"
+	"bitovi.com/code-analyzer/src/utils"
+	"go.temporal.io/sdk/activity"
+	"go.temporal.io/sdk/testsuite"
+	"go.temporal.io/sdk/workflow"
+)
+
+// askCallbacks records the outcome of an AskUpdate.
+type askCallbacks struct {
+	done bool
+	err  error
+}
+
+func (c *askCallbacks) Accept()          {}
+func (c *askCallbacks) Reject(err error) { c.done, c.err = true, err }
+func (c *askCallbacks) Complete(success interface{}, err error) {
+	c.done, c.err = true, err
+}
+
+func TestChatSessionOutlivesRefresh(t *testing.T) {
+	var suite testsuite.WorkflowTestSuite
+	env := suite.NewTestWorkflowEnvironment()
+	env.RegisterWorkflow(ChatSession)
+
+	var mu sync.Mutex
+	// ingested are the commits returned by successive ingestions, the last
+	// one repeating, and indexed is the only commit with documents.
+	ingested := []string{oldCommit}
+	indexed := oldCommit
+	var retrieved []string
+
+	env.RegisterWorkflowWithOptions(func(ctx workflow.Context, input IngestRepositoryInput) (IngestRepositoryOutput, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		commit := ingested[0]
+		if len(ingested) > 1 {
+			ingested = ingested[1:]
+		}
+		return IngestRepositoryOutput{Commit: commit}, nil
+	}, workflow.RegisterOptions{Name: "IngestRepository"})
+	env.RegisterActivityWithOptions(func(ctx context.Context, input db.GetRelatedDocumentsInput) (db.GetRelatedDocumentsOutput, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		retrieved = append(retrieved, input.Commit)
+		if input.Commit != indexed {
+			return db.GetRelatedDocumentsOutput{}, utils.NonRetryableError(utils.ErrNotReady, fmt.Errorf("commit %s is not indexed", input.Commit))
+		}
+		return db.GetRelatedDocumentsOutput{}, nil
+	}, activity.RegisterOptions{Name: "GetRelatedDocuments"})
+	env.RegisterActivityWithOptions(func(ctx context.Context, input llm.InvokePromptInput) (llm.InvokePromptOutput, error) {
+		return llm.InvokePromptOutput{Response: "an answer"}, nil
+	}, activity.RegisterOptions{Name: "InvokePrompt"})
+
+	var before, after askCallbacks
+	env.RegisterDelayedCallback(func() {
+		env.UpdateWorkflow(AskUpdate, "before", &before, ChatQuestion{Query: "what does it do?"})
+	}, time.Minute)
+	env.RegisterDelayedCallback(func() {
+		// A refresh moves the ref to a new commit and deletes the documents
+		// of the old one. The session's next ingestion still sees the old
+		// commit, as if the refresh finished right after it.
+		mu.Lock()
+		defer mu.Unlock()
+		indexed = newCommit
+		ingested = []string{oldCommit, newCommit}
+	}, time.Hour)
+	env.RegisterDelayedCallback(func() {
+		env.UpdateWorkflow(AskUpdate, "after", &after, ChatQuestion{Query: "and now?"})
+	}, 2*time.Hour)
+
+	env.ExecuteWorkflow(ChatSession, ChatSessionInput{Repository: testRepository, User: "alice"})
+	if !env.IsWorkflowCompleted() {
+		t.Fatal("the session did not end")
+	}
+	if err := env.GetWorkflowError(); err != nil {
+		t.Fatalf("the session failed: %v", err)
+	}
+
+	for name, ask := range map[string]*askCallbacks{"before": &before, "after": &after} {
+		if !ask.done {
+			t.Errorf("the question asked %s the refresh was not answered", name)
+		} else if ask.err != nil {
+			t.Errorf("the question asked %s the refresh failed: %v", name, ask.err)
+		}
+	}
+	want := []string{oldCommit, oldCommit, newCommit}
+	if fmt.Sprint(retrieved) != fmt.Sprint(want) {
+		t.Errorf("retrieved documents at %v, want %v", retrieved, want)
+	}
+}
+
+func TestChatOptionsEqual(t *testing.T) {
+	warm, alsoWarm, cold := 0.7, 0.7, 0.0
+	base := ChatOptions{
+		RetrievalMode: db.RetrievalHybrid,
+		TopK:          5,
+		Filter:        db.DocumentFilter{Include: []string{"src/**"}},
+		Completion:    llm.CompletionOptions{Model: "gpt-4o", Temperature: &warm},
+	}
+
+	tests := []struct {
+		name  string
+		edit  func(o *ChatOptions)
+		equal bool
+	}{
+		{"same", func(o *ChatOptions) {}, true},
+		{"same temperature at another address", func(o *ChatOptions) { o.Completion.Temperature = &alsoWarm }, true},
+		{"empty instead of missing list", func(o *ChatOptions) { o.Filter.Languages = []string{} }, true},
+		{"mode", func(o *ChatOptions) { o.RetrievalMode = db.RetrievalLexical }, false},
+		{"top k", func(o *ChatOptions) { o.TopK = 10 }, false},
+		{"filter", func(o *ChatOptions) { o.Filter.Include = []string{"docs/**"} }, false},
+		{"model", func(o *ChatOptions) { o.Completion.Model = "gpt-4o-mini" }, false},
+		{"temperature", func(o *ChatOptions) { o.Completion.Temperature = &cold }, false},
+		{"no temperature", func(o *ChatOptions) { o.Completion.Temperature = nil }, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			other := base
+			test.edit(&other)
+			if got := base.Equal(other); got != test.equal {
+				t.Errorf("Equal = %v, want %v", got, test.equal)
+			}
+		})
+	}
+}
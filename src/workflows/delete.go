@@ -0,0 +1,33 @@
+package workflows
+
+import (
+	"bitovi.com/code-analyzer/src/activities/db"
+	"bitovi.com/code-analyzer/src/activities/git"
+	"go.temporal.io/sdk/workflow"
+)
+
+type DeleteRepositoryInput struct {
+	Repository string
+	Ref        string
+}
+
+// DeleteRepository drops the index of a ref. It is started under the
+// IngestionWorkflowID of the ref, so that it never runs alongside an
+// ingestion of the same ref.
+func DeleteRepository(ctx workflow.Context, input DeleteRepositoryInput) (int, error) {
+	ref := input.Ref
+	if ref == "" {
+		ref = git.DefaultRef
+	}
+
+	var deleted int
+	err := workflow.ExecuteActivity(
+		workflow.WithActivityOptions(ctx, defaultActivityOptions),
+		db.DeleteRepository,
+		db.DeleteRepositoryInput{
+			Repository: input.Repository,
+			Ref:        ref,
+		},
+	).Get(ctx, &deleted)
+	return deleted, err
+}
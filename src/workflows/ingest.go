@@ -0,0 +1,533 @@
+package workflows
+
+import (
+	"fmt"
+	"time"
+
+	"bitovi.com/code-analyzer/src/activities/db"
+	"bitovi.com/code-analyzer/src/activities/git"
+	"bitovi.com/code-analyzer/src/activities/llm"
+	"bitovi.com/code-analyzer/src/activities/s3"
+	"bitovi.com/code-analyzer/src/utils"
+	"go.temporal.io/api/enums/v1"
+	"go.temporal.io/sdk/temporal"
+	"go.temporal.io/sdk/workflow"
+)
+
+// Activities that write to the bucket or the database are waited for when
+// cancelled, so that compensations run after they have stopped.
+var archiveActivityOptions = workflow.ActivityOptions{
+	StartToCloseTimeout: time.Hour,
+	HeartbeatTimeout:    time.Minute,
+	WaitForCancellation: true,
+}
+
+// Rolling back gives up after a few attempts rather than keeping a failed
+// ingestion open.
+var rollbackActivityOptions = workflow.ActivityOptions{
+	StartToCloseTimeout: time.Minute,
+	RetryPolicy: &temporal.RetryPolicy{
+		MaximumAttempts: 5,
+	},
+}
+
+const (
+	ingestionPollInterval    = time.Second * 2
+	maxIngestionPollInterval = time.Second * 30
+)
+
+type IngestRepositoryInput struct {
+	Repository string
+	Ref        string
+	// Reindex drops the index of the ref before ingesting it again from
+	// scratch, rather than only embedding the files changed since the last
+	// ingestion. Documents shared with other refs are kept and reused.
+	Reindex bool
+}
+type IngestRepositoryOutput struct {
+	Commit   string
+	UpToDate bool
+	IngestProgress
+}
+
+const (
+	PhaseResolving   = "resolving"
+	PhaseArchiving   = "archiving"
+	PhaseEmbedding   = "embedding"
+	PhaseCleaningUp  = "cleaning up"
+	PhaseDone        = "done"
+	PhaseRollingBack = "rolling back"
+	PhaseFailed      = "failed"
+)
+
+// IngestProgress is returned by the ProgressQuery of IngestRepository.
+type IngestProgress struct {
+	Phase         string
+	FilesArchived int
+	Shards        int
+	ShardsDone    int
+	FilesEmbedded int
+	FilesSkipped  int
+	FilesCopied   int
+	FilesDeleted  int
+	RowsInserted  int
+	ChunksCached  int
+	// FailedFiles lists up to maxFailedFiles of the FilesFailed files that
+	// could not be embedded and are missing from the index.
+	FilesFailed int
+	FailedFiles []db.FailedFile
+}
+
+// CacheHitRate is the share of the inserted chunks whose embedding was found
+// in the embedding cache.
+func (p IngestProgress) CacheHitRate() float64 {
+	if p.RowsInserted == 0 {
+		return 0
+	}
+	return float64(p.ChunksCached) / float64(p.RowsInserted)
+}
+
+// IngestionWorkflowID is the ID of IngestRepository for a ref. Ingestion is
+// always started under this ID, so that Temporal runs at most one ingestion
+// per ref at a time.
+func IngestionWorkflowID(repository string, ref string) string {
+	if ref == "" {
+		ref = git.DefaultRef
+	}
+	return utils.StableID("ingest-", repository, ref)
+}
+
+// ingestRef brings the index of a ref up to date through an IngestRepository
+// child. When the ref is already being ingested, by a workflow that may be
+// serving another user, it waits for that ingestion to finish and tries
+// again, which then finds the index up to date.
+//
+// Other workflows may be waiting for the same ingestion, so it is started in
+// a disconnected context and abandoned rather than cancelled when this
+// workflow is cancelled or closes.
+func ingestRef(ctx workflow.Context, input IngestRepositoryInput, waiting func()) (IngestRepositoryOutput, error) {
+	disconnectedCtx, _ := workflow.NewDisconnectedContext(ctx)
+	childCtx := workflow.WithChildOptions(disconnectedCtx, workflow.ChildWorkflowOptions{
+		WorkflowID:        IngestionWorkflowID(input.Repository, input.Ref),
+		ParentClosePolicy: enums.PARENT_CLOSE_POLICY_ABANDON,
+	})
+
+	delay := ingestionPollInterval
+	for {
+		var ingestion IngestRepositoryOutput
+		var err error
+		selector := workflow.NewSelector(ctx)
+		selector.AddFuture(workflow.ExecuteChildWorkflow(childCtx, IngestRepository, input), func(f workflow.Future) {
+			err = f.Get(ctx, &ingestion)
+		})
+		selector.AddReceive(ctx.Done(), func(workflow.ReceiveChannel, bool) {
+			err = ctx.Err()
+		})
+		selector.Select(ctx)
+		if !temporal.IsWorkflowExecutionAlreadyStartedError(err) {
+			return ingestion, err
+		}
+
+		if waiting != nil {
+			waiting()
+		}
+		if err := workflow.Sleep(ctx, delay); err != nil {
+			return IngestRepositoryOutput{}, err
+		}
+		delay = min(delay*2, maxIngestionPollInterval)
+	}
+}
+
+func IngestRepository(ctx workflow.Context, input IngestRepositoryInput) (output IngestRepositoryOutput, err error) {
+	ref := input.Ref
+	if ref == "" {
+		ref = git.DefaultRef
+	}
+
+	progress := IngestProgress{Phase: PhaseResolving}
+	err = workflow.SetQueryHandler(ctx, ProgressQuery, func() (IngestProgress, error) {
+		return progress, nil
+	})
+	if err != nil {
+		return IngestRepositoryOutput{}, err
+	}
+
+	// Compensations undo the steps taken so far, newest first, when ingestion
+	// fails or is cancelled. They run in a disconnected context, which is not
+	// cancelled along with the workflow.
+	var compensations []func(ctx workflow.Context) error
+	defer func() {
+		if err == nil {
+			return
+		}
+		progress.Phase = PhaseRollingBack
+		disconnectedCtx, _ := workflow.NewDisconnectedContext(ctx)
+		for i := len(compensations) - 1; i >= 0; i-- {
+			if compensationErr := compensations[i](disconnectedCtx); compensationErr != nil {
+				workflow.GetLogger(ctx).Error("Unable to roll back ingestion", "Error", compensationErr)
+			}
+		}
+		progress.Phase = PhaseFailed
+
+		statusErr := workflow.ExecuteActivity(
+			workflow.WithActivityOptions(disconnectedCtx, rollbackActivityOptions),
+			db.UpdateRepositoryStatus,
+			db.UpdateRepositoryStatusInput{
+				Repository: input.Repository,
+				Ref:        ref,
+				Status:     db.StatusFailed,
+				Phase:      PhaseFailed,
+				Error:      err.Error(),
+			},
+		).Get(disconnectedCtx, nil)
+		if statusErr != nil {
+			workflow.GetLogger(ctx).Error("Unable to record failed ingestion", "Error", statusErr)
+		}
+	}()
+
+	if input.Reindex {
+		err = workflow.ExecuteActivity(
+			workflow.WithActivityOptions(ctx, defaultActivityOptions),
+			db.DeleteRepository,
+			db.DeleteRepositoryInput{
+				Repository: input.Repository,
+				Ref:        ref,
+			},
+		).Get(ctx, nil)
+		if err != nil {
+			return IngestRepositoryOutput{}, err
+		}
+	}
+
+	var stored db.Repository
+	err = workflow.ExecuteActivity(
+		workflow.WithActivityOptions(ctx, defaultActivityOptions),
+		db.GetRepository,
+		db.GetRepositoryInput{
+			Repository: input.Repository,
+			Ref:        ref,
+		},
+	).Get(ctx, &stored)
+	if err != nil {
+		return IngestRepositoryOutput{}, err
+	}
+
+	var embeddingModel string
+	err = workflow.ExecuteActivity(
+		workflow.WithActivityOptions(ctx, defaultActivityOptions),
+		llm.GetEmbeddingModel,
+	).Get(ctx, &embeddingModel)
+	if err != nil {
+		return IngestRepositoryOutput{}, err
+	}
+	storedCommit := stored.Commit
+	if stored.EmbeddingModel != embeddingModel {
+		// Queries embedded with the current model cannot be compared with
+		// documents embedded with another, so none of them can be kept.
+		storedCommit = ""
+	}
+
+	// setPhase records the phase in the progress query and in the
+	// repositories table.
+	setPhase := func(status string, phase string, commit string) error {
+		progress.Phase = phase
+		return workflow.ExecuteActivity(
+			workflow.WithActivityOptions(ctx, defaultActivityOptions),
+			db.UpdateRepositoryStatus,
+			db.UpdateRepositoryStatusInput{
+				Repository:    input.Repository,
+				Ref:           ref,
+				Status:        status,
+				Phase:         phase,
+				PendingCommit: commit,
+			},
+		).Get(ctx, nil)
+	}
+	if stored.Status == "" {
+		if err = setPhase(db.StatusPending, PhaseResolving, ""); err != nil {
+			return IngestRepositoryOutput{}, err
+		}
+	}
+
+	var headCommit string
+	err = workflow.ExecuteActivity(
+		workflow.WithActivityOptions(ctx, defaultActivityOptions),
+		git.ResolveCommit,
+		git.ResolveCommitInput{
+			Repository: input.Repository,
+			Ref:        ref,
+		},
+	).Get(ctx, &headCommit)
+	if err != nil {
+		return IngestRepositoryOutput{}, err
+	}
+
+	if storedCommit == headCommit {
+		// A later ingestion of the ref may have failed since.
+		if stored.Status != db.StatusReady {
+			err = workflow.ExecuteActivity(
+				workflow.WithActivityOptions(ctx, defaultActivityOptions),
+				db.SetRepositoryCommit,
+				db.SetRepositoryCommitInput{
+					Repository:     input.Repository,
+					Ref:            ref,
+					Commit:         headCommit,
+					EmbeddingModel: embeddingModel,
+					FilesFailed:    stored.FilesFailed,
+				},
+			).Get(ctx, nil)
+			if err != nil {
+				return IngestRepositoryOutput{}, err
+			}
+		}
+		progress.Phase = PhaseDone
+		return IngestRepositoryOutput{
+			Commit:         headCommit,
+			UpToDate:       true,
+			IngestProgress: progress,
+		}, nil
+	}
+
+	// Another ref may already point at this commit, in which case its
+	// documents can be shared as they are.
+	var indexed bool
+	err = workflow.ExecuteActivity(
+		workflow.WithActivityOptions(ctx, defaultActivityOptions),
+		db.IsCommitIndexed,
+		db.IsCommitIndexedInput{
+			Repository:     input.Repository,
+			Commit:         headCommit,
+			EmbeddingModel: embeddingModel,
+		},
+	).Get(ctx, &indexed)
+	if err != nil {
+		return IngestRepositoryOutput{}, err
+	}
+	if indexed {
+		err = workflow.ExecuteActivity(
+			workflow.WithActivityOptions(ctx, defaultActivityOptions),
+			db.SetRepositoryCommit,
+			db.SetRepositoryCommitInput{
+				Repository:     input.Repository,
+				Ref:            ref,
+				Commit:         headCommit,
+				EmbeddingModel: embeddingModel,
+			},
+		).Get(ctx, nil)
+		if err != nil {
+			return IngestRepositoryOutput{}, err
+		}
+		progress.Phase = PhaseDone
+		return IngestRepositoryOutput{
+			Commit:         headCommit,
+			UpToDate:       true,
+			IngestProgress: progress,
+		}, nil
+	}
+
+	if err = setPhase(db.StatusIngesting, PhaseArchiving, headCommit); err != nil {
+		return IngestRepositoryOutput{}, err
+	}
+	bucketName := s3.BucketName(input.Repository, headCommit)
+
+	compensations = append(compensations, func(ctx workflow.Context) error {
+		return workflow.ExecuteActivity(
+			workflow.WithActivityOptions(ctx, rollbackActivityOptions),
+			s3.DeleteBucket,
+			s3.DeleteBucketInput{
+				Bucket: bucketName,
+			},
+		).Get(ctx, nil)
+	})
+	err = workflow.ExecuteActivity(
+		workflow.WithActivityOptions(ctx, defaultActivityOptions),
+		s3.CreateBucket,
+		s3.CreateBucketInput{
+			Bucket: bucketName,
+		},
+	).Get(ctx, nil)
+	if err != nil {
+		return IngestRepositoryOutput{}, err
+	}
+
+	var archiveResult git.ArchiveRepositoryOutput
+	err = workflow.ExecuteActivity(
+		workflow.WithActivityOptions(ctx, archiveActivityOptions),
+		git.ArchiveRepository,
+		git.ArchiveRepositoryInput{
+			Repository: input.Repository,
+			Bucket:     bucketName,
+			Ref:        headCommit,
+			BaseCommit: storedCommit,
+		},
+	).Get(ctx, &archiveResult)
+	if err != nil {
+		return IngestRepositoryOutput{}, err
+	}
+	progress.FilesArchived = archiveResult.FileCount
+	progress.FilesDeleted = archiveResult.DeletedCount
+
+	staleManifests := []string{archiveResult.ManifestKey, archiveResult.DeletedManifestKey}
+
+	// Until the ref points at it, the new commit only has the rows written
+	// below. Another ref may have finished indexing the same commit in the
+	// meantime, in which case its rows are kept.
+	compensations = append(compensations, func(ctx workflow.Context) error {
+		return workflow.ExecuteActivity(
+			workflow.WithActivityOptions(ctx, rollbackActivityOptions),
+			db.DeleteUnreferencedDocuments,
+			db.DeleteUnreferencedDocumentsInput{
+				Repository: input.Repository,
+				Commit:     archiveResult.Commit,
+			},
+		).Get(ctx, nil)
+	})
+
+	err = workflow.ExecuteActivity(
+		workflow.WithActivityOptions(ctx, defaultActivityOptions),
+		db.DeleteDocuments,
+		db.DeleteDocumentsInput{
+			Repository:     input.Repository,
+			Commit:         archiveResult.Commit,
+			EmbeddingModel: embeddingModel,
+			Bucket:         bucketName,
+			Manifests:      staleManifests,
+			All:            !archiveResult.Incremental,
+		},
+	).Get(ctx, nil)
+	if err != nil {
+		return IngestRepositoryOutput{}, err
+	}
+
+	if archiveResult.Incremental {
+		err = workflow.ExecuteActivity(
+			workflow.WithActivityOptions(ctx, defaultActivityOptions),
+			db.CopyDocuments,
+			db.CopyDocumentsInput{
+				Repository:       input.Repository,
+				FromCommit:       storedCommit,
+				ToCommit:         archiveResult.Commit,
+				EmbeddingModel:   embeddingModel,
+				Bucket:           bucketName,
+				ExcludeManifests: staleManifests,
+			},
+		).Get(ctx, &progress.FilesCopied)
+		if err != nil {
+			return IngestRepositoryOutput{}, err
+		}
+	}
+
+	if err = setPhase(db.StatusIngesting, PhaseEmbedding, headCommit); err != nil {
+		return IngestRepositoryOutput{}, err
+	}
+	progress.Shards = (archiveResult.FileCount + filesPerShard - 1) / filesPerShard
+	err = ingestShards(ctx, IngestShardInput{
+		Repository: input.Repository,
+		Commit:     archiveResult.Commit,
+		Bucket:     bucketName,
+		Manifest:   archiveResult.ManifestKey,
+	}, archiveResult.FileCount, &progress)
+	if err != nil {
+		return IngestRepositoryOutput{}, err
+	}
+
+	if err = setPhase(db.StatusIngesting, PhaseCleaningUp, headCommit); err != nil {
+		return IngestRepositoryOutput{}, err
+	}
+	err = workflow.ExecuteActivity(
+		workflow.WithActivityOptions(ctx, defaultActivityOptions),
+		s3.DeleteBucket,
+		s3.DeleteBucketInput{
+			Bucket: bucketName,
+		},
+	).Get(ctx, nil)
+	if err != nil {
+		// The documents are already stored, a leftover bucket is no reason to
+		// fail the ingestion.
+		workflow.GetLogger(ctx).Warn("Unable to delete bucket", "Bucket", bucketName, "Error", err)
+	}
+
+	err = workflow.ExecuteActivity(
+		workflow.WithActivityOptions(ctx, defaultActivityOptions),
+		db.SetRepositoryCommit,
+		db.SetRepositoryCommitInput{
+			Repository:     input.Repository,
+			Ref:            ref,
+			Commit:         archiveResult.Commit,
+			EmbeddingModel: embeddingModel,
+			FilesFailed:    progress.FilesFailed,
+		},
+	).Get(ctx, nil)
+	if err != nil {
+		return IngestRepositoryOutput{}, err
+	}
+
+	progress.Phase = PhaseDone
+	workflow.GetLogger(ctx).Info(
+		"Ingested repository",
+		"Commit", archiveResult.Commit,
+		"FilesEmbedded", progress.FilesEmbedded,
+		"RowsInserted", progress.RowsInserted,
+		"ChunksCached", progress.ChunksCached,
+		"FilesFailed", progress.FilesFailed,
+		"CacheHitRate", progress.CacheHitRate(),
+	)
+	return IngestRepositoryOutput{
+		Commit:         archiveResult.Commit,
+		IngestProgress: progress,
+	}, nil
+}
+
+// ingestShards runs an IngestShard child workflow for every filesPerShard
+// files of the manifest, a few at a time, adding their counts to progress as
+// they complete.
+func ingestShards(ctx workflow.Context, shard IngestShardInput, fileCount int, progress *IngestProgress) error {
+	workflowID := workflow.GetInfo(ctx).WorkflowExecution.ID
+
+	// On failure, the remaining shards are cancelled and waited for, so that
+	// none is still writing rows when IngestRepository rolls back.
+	ctx, cancel := workflow.WithCancel(ctx)
+	defer cancel()
+
+	var err error
+	running := 0
+	selector := workflow.NewSelector(ctx)
+	for i := 0; i < progress.Shards || running > 0; {
+		for ; i < progress.Shards && running < concurrentShards; i++ {
+			shard.Offset = i * filesPerShard
+			shard.Limit = min(filesPerShard, fileCount-shard.Offset)
+			childCtx := workflow.WithChildOptions(ctx, workflow.ChildWorkflowOptions{
+				WorkflowID:          fmt.Sprintf("%s-shard-%d", workflowID, i),
+				WaitForCancellation: true,
+			})
+			f := workflow.ExecuteChildWorkflow(childCtx, IngestShard, shard)
+			selector.AddFuture(f, func(f workflow.Future) {
+				running--
+				var indexed db.IndexFilesOutput
+				if shardErr := f.Get(ctx, &indexed); shardErr != nil {
+					if err == nil {
+						err = shardErr
+					}
+					return
+				}
+				progress.ShardsDone++
+				progress.FilesEmbedded += indexed.FilesEmbedded
+				progress.FilesSkipped += indexed.FilesSkipped
+				progress.RowsInserted += indexed.RowsInserted
+				progress.ChunksCached += indexed.ChunksCached
+				progress.FilesFailed += indexed.FilesFailed
+				progress.FailedFiles = appendFailedFiles(progress.FailedFiles, indexed.FailedFiles)
+			})
+			running++
+		}
+		selector.Select(ctx)
+		if err != nil {
+			cancel()
+			for running > 0 {
+				selector.Select(ctx)
+			}
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,308 @@
+package workflows
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"bitovi.com/code-analyzer/src/activities/db"
+	"bitovi.com/code-analyzer/src/activities/git"
+	"bitovi.com/code-analyzer/src/activities/s3"
+	"bitovi.com/code-analyzer/src/utils"
+	"go.temporal.io/sdk/activity"
+	"go.temporal.io/sdk/testsuite"
+	"go.temporal.io/sdk/workflow"
+)
+
+const (
+	testRepository = "https://github.com/bitovi/example"
+	testModel      = "test-model"
+	oldCommit      = "1111111111111111111111111111111111111111"
+	newCommit      = "2222222222222222222222222222222222222222"
+)
+
+// fakeIngestion stands in for the activities of IngestRepository and records
+// which of them ran.
+type fakeIngestion struct {
+	stored   db.Repository
+	indexErr error
+
+	mu       sync.Mutex
+	calls    []string
+	archived git.ArchiveRepositoryInput
+	statuses []string
+	cleaned  []string
+	// models are the embedding models the documents were written and
+	// recorded with.
+	models []string
+}
+
+func (f *fakeIngestion) record(name string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, name)
+}
+
+func (f *fakeIngestion) recordModel(name string, model string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, name)
+	f.models = append(f.models, model)
+}
+
+func (f *fakeIngestion) called(name string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, call := range f.calls {
+		if call == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *fakeIngestion) register(env *testsuite.TestWorkflowEnvironment) {
+	register := func(fn interface{}, name string) {
+		env.RegisterActivityWithOptions(fn, activity.RegisterOptions{Name: name})
+	}
+
+	register(func(ctx context.Context, input db.GetRepositoryInput) (db.Repository, error) {
+		f.record("GetRepository")
+		return f.stored, nil
+	}, "GetRepository")
+	register(func(ctx context.Context) (string, error) {
+		f.record("GetEmbeddingModel")
+		return testModel, nil
+	}, "GetEmbeddingModel")
+	register(func(ctx context.Context, input db.UpdateRepositoryStatusInput) error {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.statuses = append(f.statuses, input.Status)
+		return nil
+	}, "UpdateRepositoryStatus")
+	register(func(ctx context.Context, input git.ResolveCommitInput) (string, error) {
+		f.record("ResolveCommit")
+		return newCommit, nil
+	}, "ResolveCommit")
+	register(func(ctx context.Context, input db.IsCommitIndexedInput) (bool, error) {
+		f.record("IsCommitIndexed")
+		return false, nil
+	}, "IsCommitIndexed")
+	register(func(input s3.CreateBucketInput) error {
+		f.record("CreateBucket")
+		return nil
+	}, "CreateBucket")
+	register(func(ctx context.Context, input git.ArchiveRepositoryInput) (git.ArchiveRepositoryOutput, error) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.calls = append(f.calls, "ArchiveRepository")
+		f.archived = input
+		return git.ArchiveRepositoryOutput{
+			Commit:      newCommit,
+			FileCount:   3,
+			ManifestKey: "manifest",
+			Incremental: input.BaseCommit != "",
+		}, nil
+	}, "ArchiveRepository")
+	register(func(ctx context.Context, input db.DeleteDocumentsInput) (int, error) {
+		f.recordModel("DeleteDocuments", input.EmbeddingModel)
+		return 0, nil
+	}, "DeleteDocuments")
+	register(func(ctx context.Context, input db.CopyDocumentsInput) (int, error) {
+		f.recordModel("CopyDocuments", input.EmbeddingModel)
+		return 0, nil
+	}, "CopyDocuments")
+	register(func(ctx context.Context, input db.IndexFilesInput) (db.IndexFilesOutput, error) {
+		f.record("IndexFiles")
+		if f.indexErr != nil {
+			return db.IndexFilesOutput{}, f.indexErr
+		}
+		return db.IndexFilesOutput{FilesEmbedded: len(input.Keys), RowsInserted: len(input.Keys)}, nil
+	}, "IndexFiles")
+	register(func(input s3.GetManifestKeysInput) ([]string, error) {
+		keys := make([]string, input.Limit)
+		for i := range keys {
+			keys[i] = fmt.Sprintf("file-%d", input.Offset+i)
+		}
+		return keys, nil
+	}, "GetManifestKeys")
+	register(func(input s3.DeleteBucketInput) error {
+		f.record("DeleteBucket")
+		return nil
+	}, "DeleteBucket")
+	register(func(ctx context.Context, input db.DeleteUnreferencedDocumentsInput) (int, error) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.calls = append(f.calls, "DeleteUnreferencedDocuments")
+		f.cleaned = append(f.cleaned, input.Commit)
+		return 0, nil
+	}, "DeleteUnreferencedDocuments")
+	register(func(ctx context.Context, input db.SetRepositoryCommitInput) error {
+		f.recordModel("SetRepositoryCommit", input.EmbeddingModel)
+		return nil
+	}, "SetRepositoryCommit")
+}
+
+func TestIngestRepository(t *testing.T) {
+	readyAt := func(commit string, model string) db.Repository {
+		return db.Repository{Repository: testRepository, Ref: git.DefaultRef, Commit: commit, Status: db.StatusReady, EmbeddingModel: model}
+	}
+
+	tests := []struct {
+		name     string
+		stored   db.Repository
+		indexErr error
+		// failed is whether the ingestion fails and is rolled back.
+		failed      bool
+		upToDate    bool
+		incremental bool
+	}{
+		{
+			name:     "first ingestion",
+			stored:   db.Repository{Repository: testRepository, Ref: git.DefaultRef},
+			upToDate: false,
+		},
+		{
+			name:     "up to date",
+			stored:   readyAt(newCommit, testModel),
+			upToDate: true,
+		},
+		{
+			name:        "new commit",
+			stored:      readyAt(oldCommit, testModel),
+			incremental: true,
+		},
+		{
+			name:   "new commit embedded with another model",
+			stored: readyAt(oldCommit, "other-model"),
+		},
+		{
+			name:   "same commit embedded with another model",
+			stored: readyAt(newCommit, "other-model"),
+		},
+		{
+			name:     "failed embedding is rolled back",
+			stored:   readyAt(oldCommit, testModel),
+			indexErr: utils.NonRetryableError(utils.ErrBadCredentials, errors.New("invalid API key")),
+			failed:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var suite testsuite.WorkflowTestSuite
+			env := suite.NewTestWorkflowEnvironment()
+			env.RegisterWorkflow(IngestShard)
+			fake := &fakeIngestion{stored: test.stored, indexErr: test.indexErr}
+			fake.register(env)
+
+			env.ExecuteWorkflow(IngestRepository, IngestRepositoryInput{Repository: testRepository})
+			if !env.IsWorkflowCompleted() {
+				t.Fatal("the workflow did not complete")
+			}
+
+			err := env.GetWorkflowError()
+			if test.failed {
+				if err == nil {
+					t.Fatal("the workflow succeeded, want an error")
+				}
+				if utils.ErrorType(err) != utils.ErrBadCredentials {
+					t.Errorf("the workflow failed with %v, want a %s error", err, utils.ErrBadCredentials)
+				}
+				if fake.called("SetRepositoryCommit") {
+					t.Error("the ref was moved to the failed commit")
+				}
+				if !fake.called("DeleteBucket") {
+					t.Error("the bucket was not deleted")
+				}
+				if len(fake.cleaned) != 1 || fake.cleaned[0] != newCommit {
+					t.Errorf("deleted the unreferenced documents of %v, want %s", fake.cleaned, newCommit)
+				}
+				if last := fake.statuses[len(fake.statuses)-1]; last != db.StatusFailed {
+					t.Errorf("the ref was left %s, want %s", last, db.StatusFailed)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("the workflow failed: %v", err)
+			}
+			var output IngestRepositoryOutput
+			if err := env.GetWorkflowResult(&output); err != nil {
+				t.Fatal(err)
+			}
+			if output.Commit != newCommit {
+				t.Errorf("ingested %s, want %s", output.Commit, newCommit)
+			}
+			if output.UpToDate != test.upToDate {
+				t.Errorf("up to date = %v, want %v", output.UpToDate, test.upToDate)
+			}
+			if test.upToDate {
+				if fake.called("ArchiveRepository") {
+					t.Error("an up to date ref was archived again")
+				}
+				return
+			}
+
+			if !fake.called("IndexFiles") || !fake.called("SetRepositoryCommit") {
+				t.Errorf("the ref was not indexed, the activities run were %v", fake.calls)
+			}
+			if fake.called("DeleteUnreferencedDocuments") {
+				t.Error("a successful ingestion was rolled back")
+			}
+			wantBase := ""
+			if test.incremental {
+				wantBase = oldCommit
+			}
+			if fake.archived.BaseCommit != wantBase {
+				t.Errorf("archived changes since %q, want %q", fake.archived.BaseCommit, wantBase)
+			}
+			if fake.called("CopyDocuments") != test.incremental {
+				t.Errorf("copied documents = %v, want %v", fake.called("CopyDocuments"), test.incremental)
+			}
+			if fake.archived.Bucket != s3.BucketName(testRepository, newCommit) {
+				t.Errorf("archived to bucket %s", fake.archived.Bucket)
+			}
+			for _, model := range fake.models {
+				if model != testModel {
+					t.Errorf("documents were written with model %q, want %q", model, testModel)
+				}
+			}
+		})
+	}
+}
+
+func TestIngestRefAbandonsIngestion(t *testing.T) {
+	var suite testsuite.WorkflowTestSuite
+	env := suite.NewTestWorkflowEnvironment()
+
+	asker := func(ctx workflow.Context) error {
+		_, err := ingestRef(ctx, IngestRepositoryInput{Repository: testRepository}, nil)
+		return err
+	}
+	slowIngestion := func(ctx workflow.Context, input IngestRepositoryInput) (IngestRepositoryOutput, error) {
+		return IngestRepositoryOutput{}, workflow.Sleep(ctx, time.Hour)
+	}
+	env.RegisterWorkflow(asker)
+	env.RegisterWorkflowWithOptions(slowIngestion, workflow.RegisterOptions{Name: "IngestRepository"})
+
+	cancelled := false
+	env.SetOnChildWorkflowCanceledListener(func(*workflow.Info) {
+		cancelled = true
+	})
+	env.RegisterDelayedCallback(env.CancelWorkflow, time.Minute)
+	env.ExecuteWorkflow(asker)
+
+	if !env.IsWorkflowCompleted() {
+		t.Fatal("the workflow did not complete")
+	}
+	if env.GetWorkflowError() == nil {
+		t.Error("the cancelled workflow succeeded")
+	}
+	if cancelled {
+		t.Error("cancelling the workflow cancelled the ingestion it shares")
+	}
+}
@@ -1,160 +1,127 @@
 package workflows
 
 import (
+	"errors"
 	"time"
 
 	"bitovi.com/code-analyzer/src/activities/db"
-	"bitovi.com/code-analyzer/src/activities/git"
 	"bitovi.com/code-analyzer/src/activities/llm"
-	"bitovi.com/code-analyzer/src/activities/s3"
 	"bitovi.com/code-analyzer/src/utils"
 	"go.temporal.io/sdk/temporal"
 	"go.temporal.io/sdk/workflow"
 )
 
+// TaskQueue is the task queue the worker polls and clients start workflows on.
+const TaskQueue = "ai-code-analyzer-queue"
+
 var defaultActivityOptions = workflow.ActivityOptions{
 	StartToCloseTimeout: 1 * time.Minute,
 }
 
+// llmRetryPolicy bounds the retries of activities calling the embedder or the
+// completer. Permanent failures, such as a rejected API key, are returned as
+// non-retryable errors and not retried at all.
+var llmRetryPolicy = temporal.RetryPolicy{
+	InitialInterval: time.Second * 8,
+	MaximumAttempts: 5,
+}
+
 type AnalyzeInput struct {
 	Repository string
+	Ref        string
 	Query      string
+	// RetrievalMode selects how related documents are found: "vector",
+	// "lexical" or "hybrid" (the default).
+	RetrievalMode string
+	// TopK is the number of snippets retrieved for the answer, 5 by default.
+	TopK int
+	// Filter restricts the snippets retrieved to part of the repository, such
+	// as the files below services/billing.
+	Filter     db.DocumentFilter
+	Completion llm.CompletionOptions
 }
 type AnalyzeOutput struct {
-	Response string
+	Response  string
+	Citations []Citation
+	// FilesFailed counts the files that could not be indexed by this run, so
+	// the answer may have missed them. FailedFiles lists some of them.
+	FilesFailed int
+	FailedFiles []db.FailedFile
 }
 
-func AnalyzeCode(ctx workflow.Context, input AnalyzeInput) (AnalyzeOutput, error) {
-	var embeddingsCount int
-	workflow.ExecuteActivity(
-		workflow.WithActivityOptions(ctx, defaultActivityOptions),
-		db.GetEmbeddingCount,
-		git.ArchiveRepositoryInput{
-			Repository: input.Repository,
-		},
-	).Get(ctx, &embeddingsCount)
-
-	if embeddingsCount == 0 {
-		bucketName := utils.CleanRepository(input.Repository)
-
-		workflow.ExecuteActivity(
-			workflow.WithActivityOptions(ctx, defaultActivityOptions),
-			s3.CreateBucket,
-			s3.CreateBucketInput{
-				Bucket: bucketName,
-			},
-		).Get(ctx, nil)
-
-		var archiveResult git.ArchiveRepositoryOutput
-		workflow.ExecuteActivity(
-			workflow.WithActivityOptions(ctx, defaultActivityOptions),
-			git.ArchiveRepository,
-			git.ArchiveRepositoryInput{
-				Repository: input.Repository,
-				Bucket:     bucketName,
-			},
-		).Get(ctx, &archiveResult)
+// ProgressQuery is the name of the query reporting the progress of
+// AnalyzeCode and IngestRepository.
+const ProgressQuery = "progress"
 
-		embeddingsFutures := make([]workflow.Future, len(archiveResult.Keys))
-		for i, key := range archiveResult.Keys {
-			f := workflow.ExecuteActivity(
-				workflow.WithRetryPolicy(
-					workflow.WithActivityOptions(ctx, defaultActivityOptions),
-					temporal.RetryPolicy{
-						InitialInterval: time.Second * 8,
-						MaximumAttempts: 5,
-					},
-				),
-				llm.GetEmbeddingData,
-				llm.GetEmbeddingDataInput{
-					Bucket: bucketName,
-					Key:    key,
-				},
-			)
-			embeddingsFutures[i] = f
-		}
+const (
+	PhaseIngesting = "ingesting"
+	// PhaseWaiting means another workflow is ingesting the ref, and
+	// AnalyzeCode waits for it to finish.
+	PhaseWaiting   = "waiting for ingestion"
+	PhaseAnswering = "answering"
+)
 
-		var embeddings []llm.GetEmbeddingDataOutput
-		for _, f := range embeddingsFutures {
-			var embeddingResult llm.GetEmbeddingDataOutput
-			f.Get(ctx, &embeddingResult)
-			if len(embeddingResult.Embedding) > 0 {
-				embeddings = append(embeddings, embeddingResult)
-			}
-		}
+// AnalyzeProgress is returned by the ProgressQuery of AnalyzeCode. The file
+// counts live on the ingestion workflow, which can be queried in turn.
+type AnalyzeProgress struct {
+	Phase               string
+	IngestionWorkflowID string
+}
 
-		insertFutures := make([]workflow.Future, len(embeddings))
-		for i, e := range embeddings {
-			f := workflow.ExecuteActivity(
-				workflow.WithActivityOptions(ctx, defaultActivityOptions),
-				db.InsertEmbedding,
-				db.InsertEmbeddingInput{
-					Bucket: bucketName,
-					EmbeddingRecord: db.EmbeddingRecord{
-						Repository: input.Repository,
-						Key:        e.Key,
-						Embedding:  e.Embedding,
-					},
-				},
-			)
-			insertFutures[i] = f
-		}
-		for _, f := range insertFutures {
-			f.Get(ctx, nil)
-		}
+func AnalyzeCode(ctx workflow.Context, input AnalyzeInput) (AnalyzeOutput, error) {
+	if input.Repository == "" || input.Query == "" {
+		return AnalyzeOutput{}, utils.NonRetryableError(utils.ErrInvalidInput, errors.New("a repository and a query are required"))
+	}
 
-		deleteObjectFutures := make([]workflow.Future, len(archiveResult.Keys))
-		for i, key := range archiveResult.Keys {
-			f := workflow.ExecuteActivity(
-				workflow.WithActivityOptions(ctx, defaultActivityOptions),
-				s3.DeleteObject,
-				s3.DeleteObjectInput{
-					Bucket: bucketName,
-					Key:    key,
-				},
-			)
-			deleteObjectFutures[i] = f
-		}
-		for _, f := range deleteObjectFutures {
-			f.Get(ctx, nil)
-		}
+	workflowID := workflow.GetInfo(ctx).WorkflowExecution.ID
 
-		workflow.ExecuteActivity(
-			workflow.WithActivityOptions(ctx, defaultActivityOptions),
-			s3.DeleteBucket,
-			s3.DeleteBucketInput{
-				Bucket: bucketName,
-			},
-		).Get(ctx, nil)
+	progress := AnalyzeProgress{
+		Phase:               PhaseIngesting,
+		IngestionWorkflowID: IngestionWorkflowID(input.Repository, input.Ref),
+	}
+	err := workflow.SetQueryHandler(ctx, ProgressQuery, func() (AnalyzeProgress, error) {
+		return progress, nil
+	})
+	if err != nil {
+		return AnalyzeOutput{}, err
 	}
 
-	var relatedDocuments db.GetRelatedDocumentsOutput
-	workflow.ExecuteActivity(
-		workflow.WithActivityOptions(ctx, defaultActivityOptions),
-		db.GetRelatedDocuments,
-		db.GetRelatedDocumentsInput{
-			Repository: input.Repository,
-			Query:      input.Query,
-			Limit:      5,
-		},
-	).Get(ctx, &relatedDocuments)
-
-	var relatedContent = make([]string, len(relatedDocuments.Records))
-	for i, record := range relatedDocuments.Records {
-		relatedContent[i] = record.Content
+	ingestion, err := ingestRef(ctx, IngestRepositoryInput{
+		Repository: input.Repository,
+		Ref:        input.Ref,
+	}, func() {
+		progress.Phase = PhaseWaiting
+	})
+	if err != nil {
+		return AnalyzeOutput{}, err
 	}
 
-	var response string
-	workflow.ExecuteActivity(
-		workflow.WithActivityOptions(ctx, defaultActivityOptions),
-		llm.InvokePrompt,
-		llm.InvokePromptInput{
-			Query:          input.Query,
-			RelatedContent: relatedContent,
+	progress.Phase = PhaseAnswering
+	var answer AnswerQueryOutput
+	err = workflow.ExecuteChildWorkflow(
+		workflow.WithChildOptions(ctx, workflow.ChildWorkflowOptions{
+			WorkflowID: AnswerWorkflowID(workflowID),
+		}),
+		AnswerQuery,
+		AnswerQueryInput{
+			Repository:    input.Repository,
+			Commit:        ingestion.Commit,
+			Query:         input.Query,
+			RetrievalMode: input.RetrievalMode,
+			TopK:          input.TopK,
+			Filter:        input.Filter,
+			Completion:    input.Completion,
 		},
-	).Get(ctx, &response)
+	).Get(ctx, &answer)
+	if err != nil {
+		return AnalyzeOutput{}, err
+	}
 
+	progress.Phase = PhaseDone
 	return AnalyzeOutput{
-		Response: response,
+		Response:    answer.Response,
+		Citations:   answer.Citations,
+		FilesFailed: ingestion.FilesFailed,
+		FailedFiles: ingestion.FailedFiles,
 	}, nil
 }
@@ -0,0 +1,20 @@
+package workflows
+
+import (
+	"go.temporal.io/sdk/workflow"
+)
+
+// RefreshRepository is the workflow run by refresh schedules. It brings the
+// index of a ref up to date with its latest commit, which does nothing when
+// the ref has not moved since the last run.
+func RefreshRepository(ctx workflow.Context, input IngestRepositoryInput) (IngestRepositoryOutput, error) {
+	ingestion, err := ingestRef(ctx, input, nil)
+	if err != nil {
+		return IngestRepositoryOutput{}, err
+	}
+
+	if ingestion.UpToDate {
+		workflow.GetLogger(ctx).Info("Index already up to date", "Repository", input.Repository, "Commit", ingestion.Commit)
+	}
+	return ingestion, nil
+}
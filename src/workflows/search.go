@@ -0,0 +1,83 @@
+package workflows
+
+import (
+	"errors"
+
+	"bitovi.com/code-analyzer/src/activities/db"
+	"bitovi.com/code-analyzer/src/utils"
+	"go.temporal.io/sdk/workflow"
+)
+
+type SearchInput struct {
+	Repository    string
+	Ref           string
+	Query         string
+	RetrievalMode string
+	TopK          int
+	Filter        db.DocumentFilter
+}
+type SearchOutput struct {
+	Commit string
+	// Results are ordered from the most to the least related.
+	Results []SearchResult
+}
+
+// SearchResult is a snippet found by SearchCode. Snippet holds the lines
+// StartLine to EndLine of the file at Path. Score is the snippet's retrieval
+// score, whose meaning depends on the retrieval mode (see db.EmbeddingRecord).
+type SearchResult struct {
+	Path      string
+	StartLine int
+	EndLine   int
+	Score     float64
+	Snippet   string
+}
+
+// SearchCode finds the snippets of a repository most related to a query,
+// without asking the LLM anything about them. Only the vector and hybrid
+// modes call the embedder, to embed the query.
+func SearchCode(ctx workflow.Context, input SearchInput) (SearchOutput, error) {
+	if input.Repository == "" || input.Query == "" {
+		return SearchOutput{}, utils.NonRetryableError(utils.ErrInvalidInput, errors.New("a repository and a query are required"))
+	}
+
+	ingestion, err := ingestRef(ctx, IngestRepositoryInput{
+		Repository: input.Repository,
+		Ref:        input.Ref,
+	}, nil)
+	if err != nil {
+		return SearchOutput{}, err
+	}
+
+	var relatedDocuments db.GetRelatedDocumentsOutput
+	err = workflow.ExecuteActivity(
+		workflow.WithRetryPolicy(workflow.WithActivityOptions(ctx, defaultActivityOptions), llmRetryPolicy),
+		db.GetRelatedDocuments,
+		db.GetRelatedDocumentsInput{
+			Repository: input.Repository,
+			Commit:     ingestion.Commit,
+			Query:      input.Query,
+			Limit:      topK(input.TopK),
+			Mode:       input.RetrievalMode,
+			Filter:     input.Filter,
+		},
+	).Get(ctx, &relatedDocuments)
+	if err != nil {
+		return SearchOutput{}, err
+	}
+
+	results := make([]SearchResult, len(relatedDocuments.Records))
+	for i, record := range relatedDocuments.Records {
+		results[i] = SearchResult{
+			Path:      record.Key,
+			StartLine: record.StartLine,
+			EndLine:   record.EndLine,
+			Score:     record.Score,
+			Snippet:   record.Content,
+		}
+	}
+	return SearchOutput{
+		Commit:  ingestion.Commit,
+		Results: results,
+	}, nil
+}
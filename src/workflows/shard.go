@@ -0,0 +1,136 @@
+package workflows
+
+import (
+	"time"
+
+	"bitovi.com/code-analyzer/src/activities/db"
+	"bitovi.com/code-analyzer/src/activities/s3"
+	"go.temporal.io/sdk/workflow"
+)
+
+const (
+	// Files of a repository are indexed by shards of filesPerShard files, each
+	// a child workflow running IndexFiles over filesPerBatch files at a time.
+	// This keeps every history small however large the repository is.
+	filesPerShard      = 2000
+	filesPerBatch      = 50
+	concurrentShards   = 4
+	concurrentBatches  = 8
+	shardHistoryLength = 10000
+
+	// maxFailedFiles bounds the failed files listed in workflow results, only
+	// their count is kept beyond it.
+	maxFailedFiles = 100
+)
+
+var indexActivityOptions = workflow.ActivityOptions{
+	// Files are embedded whole however many chunks they have, so a batch with
+	// large files can take a while. IndexFiles heartbeats throughout.
+	StartToCloseTimeout: time.Hour,
+	WaitForCancellation: true,
+	HeartbeatTimeout:    time.Minute * 5,
+	RetryPolicy:         &llmRetryPolicy,
+}
+
+type IngestShardInput struct {
+	Repository string
+	Commit     string
+	Bucket     string
+	Manifest   string
+	Offset     int
+	Limit      int
+	// Indexed carries the counts of earlier runs across continue-as-new.
+	Indexed db.IndexFilesOutput
+}
+
+// IngestShard indexes the files at [Offset, Offset+Limit) of the manifest. It
+// reads its keys from the manifest once and passes each batch its own.
+func IngestShard(ctx workflow.Context, input IngestShardInput) (db.IndexFilesOutput, error) {
+	var keys []string
+	err := workflow.ExecuteActivity(
+		workflow.WithActivityOptions(ctx, defaultActivityOptions),
+		s3.GetManifestKeys,
+		s3.GetManifestKeysInput{
+			Bucket:   input.Bucket,
+			Manifest: input.Manifest,
+			Offset:   input.Offset,
+			Limit:    input.Limit,
+		},
+	).Get(ctx, &keys)
+	if err != nil {
+		return db.IndexFilesOutput{}, err
+	}
+
+	ctx = workflow.WithActivityOptions(ctx, indexActivityOptions)
+	ctx, cancel := workflow.WithCancel(ctx)
+	defer cancel()
+	end := input.Offset + len(keys)
+
+	next := input.Offset
+	running := 0
+	selector := workflow.NewSelector(ctx)
+	for next < end || running > 0 {
+		for next < end && running < concurrentBatches {
+			batch := next - input.Offset
+			f := workflow.ExecuteActivity(ctx, db.IndexFiles, db.IndexFilesInput{
+				Repository: input.Repository,
+				Commit:     input.Commit,
+				Bucket:     input.Bucket,
+				Keys:       keys[batch:min(batch+filesPerBatch, len(keys))],
+			})
+			selector.AddFuture(f, func(f workflow.Future) {
+				running--
+				var output db.IndexFilesOutput
+				if batchErr := f.Get(ctx, &output); batchErr != nil {
+					if err == nil {
+						err = batchErr
+					}
+					return
+				}
+				input.Indexed.FilesEmbedded += output.FilesEmbedded
+				input.Indexed.FilesSkipped += output.FilesSkipped
+				input.Indexed.RowsInserted += output.RowsInserted
+				input.Indexed.ChunksCached += output.ChunksCached
+				input.Indexed.FilesFailed += output.FilesFailed
+				input.Indexed.FailedFiles = appendFailedFiles(input.Indexed.FailedFiles, output.FailedFiles)
+			})
+			next += min(filesPerBatch, end-next)
+			running++
+		}
+		selector.Select(ctx)
+		if err != nil {
+			// Stop the other batches before failing, so that none is still
+			// writing rows when IngestRepository rolls back.
+			cancel()
+			for running > 0 {
+				selector.Select(ctx)
+			}
+			return db.IndexFilesOutput{}, err
+		}
+
+		info := workflow.GetInfo(ctx)
+		if next < end && (info.GetContinueAsNewSuggested() || info.GetCurrentHistoryLength() > shardHistoryLength) {
+			for running > 0 {
+				selector.Select(ctx)
+			}
+			if err != nil {
+				return db.IndexFilesOutput{}, err
+			}
+			input.Limit = end - next
+			input.Offset = next
+			return db.IndexFilesOutput{}, workflow.NewContinueAsNewError(ctx, IngestShard, input)
+		}
+	}
+
+	return input.Indexed, nil
+}
+
+func appendFailedFiles(failed []db.FailedFile, more []db.FailedFile) []db.FailedFile {
+	for _, file := range more {
+		if len(failed) >= maxFailedFiles {
+			break
+		}
+		failed = append(failed, file)
+	}
+	return failed
+}